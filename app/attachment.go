@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// An audio file uploaded to discord, downloaded to a temporary file so it can be played after the upload link expires
+type attachment_source struct {
+    path string
+}
+
+var (
+    attachment_extensions = map[string]bool{
+        ".mp3": true,
+        ".flac": true,
+        ".ogg": true,
+        ".opus": true,
+        ".m4a": true,
+        ".aac": true,
+        ".wav": true,
+        ".webm": true,
+    }
+    attachment_http_client = &http.Client{Timeout: 2 * time.Minute}
+)
+
+const (
+    attachment_probe_timeout time.Duration = 10 * time.Second
+)
+
+
+func (a *attachment_source) open() (io.ReadCloser, error) {
+    return os.Open(a.path)
+}
+
+
+// Deletes the temporary file once the track is no longer in the queue
+func (a *attachment_source) release() {
+    err := os.Remove(a.path)
+    if err != nil && !os.IsNotExist(err) {
+        log.Printf("removing attachment %s: %s\n", a.path, err.Error())
+    }
+}
+
+
+// Makes sure an attachment looks like audio and is not too big before downloading it
+func check_attachment(a *discordgo.MessageAttachment) error {
+    if a.Size > settings.attachment_max_bytes {
+        return fmt.Errorf("'%s' is too big, the limit is %d MB", a.Filename, settings.attachment_max_bytes/(1024*1024))
+    }
+
+    ext := strings.ToLower(filepath.Ext(a.Filename))
+    if !attachment_extensions[ext] && !strings.HasPrefix(a.ContentType, "audio/") {
+        return fmt.Errorf("'%s' is not a supported audio file", a.Filename)
+    }
+
+    return nil
+}
+
+
+// Downloads an attachment into a temporary file, stopping if it turns out to be bigger than it claimed
+func download_attachment(a *discordgo.MessageAttachment) (string, error) {
+    resp, err := attachment_http_client.Get(a.URL)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+    }
+
+    f, err := os.CreateTemp("", "attachment-*"+strings.ToLower(filepath.Ext(a.Filename)))
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+
+    // Read one byte past the limit to find out if the limit was exceeded
+    n, err := io.Copy(f, io.LimitReader(resp.Body, int64(settings.attachment_max_bytes)+1))
+    if err == nil && n > int64(settings.attachment_max_bytes) {
+        err = fmt.Errorf("'%s' is too big, the limit is %d MB", a.Filename, settings.attachment_max_bytes/(1024*1024))
+    }
+    if err != nil {
+        os.Remove(f.Name())
+        return "", err
+    }
+
+    return f.Name(), nil
+}
+
+
+func track_from_attachment(a *discordgo.MessageAttachment, requester string) (*Track, error) {
+    err := check_attachment(a)
+    if err != nil {
+        return nil, err
+    }
+
+    path, err := download_attachment(a)
+    if err != nil {
+        return nil, err
+    }
+
+    // Make sure ffmpeg can actually read the file, and find out how long it is
+    ctx, cancel := context.WithTimeout(context.Background(), attachment_probe_timeout)
+    defer cancel()
+    probe, err := probe_media(path, ctx)
+    if err != nil || probe.duration == 0 {
+        os.Remove(path)
+        return nil, fmt.Errorf("'%s' could not be read as audio", a.Filename)
+    }
+
+    title := probe.tags["title"]
+    if title == "" {
+        title = a.Filename
+    }
+
+    return &Track{
+        id: "att:" + a.ID,
+        title: title,
+        duration: probe.duration,
+        requester: requester,
+        source: &attachment_source{path: path},
+    }, nil
+}
+
+
+// Handles `play` with no link, queueing every audio file attached to the message
+func play_attachments(s *discordgo.Session, m *discordgo.MessageCreate) {
+    tracks := []*Track{}
+    for _, a := range m.Attachments {
+        track, err := track_from_attachment(a, m.Author.Username)
+        if err != nil {
+            s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Skipping attachment: %s", err.Error()))
+            log.Printf("attachment: %s\n", err.Error())
+            continue
+        }
+        log.Printf("downloaded attachment: [%s] - [%s]\n", track.title, a.Filename)
+        tracks = append(tracks, track)
+    }
+
+    switch len(tracks) {
+    case 0:
+        return
+    case 1:
+        enqueue_track(s, m, tracks[0])
+    default:
+        enqueue_tracks(s, m, tracks, fmt.Sprintf("Queued %d attached files", len(tracks)))
+    }
+}
@@ -3,29 +3,55 @@ package main
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 )
 
+var (
+    // Turns a track's encoded audio into PCM, tests swap this out so they do not need ffmpeg
+    decode_pcm = convert_to_pcm
+    // Cause given to eas_cancel when a track played all the way through, as opposed to being skipped or failing
+    err_song_finished = fmt.Errorf("Song finished")
+)
+
+// Information about a media file or URL as reported by ffprobe
+type ProbeResult struct {
+    duration time.Duration
+    // Tag names are lower cased, as different containers use different casing
+    tags map[string]string
+    format_name string
+}
+
+
+func convert_to_pcm(audio_stream io.ReadCloser, start time.Duration, graph string, ctx context.Context) (io.ReadCloser, error) {
+    args, piped := pcm_args(audio_stream, start, graph)
 
-func convert_m4a_pcm(audio_stream io.ReadCloser, ctx context.Context) (io.ReadCloser, error) {
-    // Build the FFmpeg command using pipes for stdin and stdout
-    // This removes the need to write any data to a file on the disk, as all audio data gets sent / recevied directrly between this program and ffmpeg
-    cmd := fmt.Sprintf("ffmpeg -i pipe:.m4a -f s16le -ar 48000 -ac 2 pipe:1")
+    // ffmpeg opens the input itself when seeking, so the stream that was already opened is not needed
+    if !piped {
+        audio_stream.Close()
+    }
 
-    // Build the command with a cancellable context
-    c := exec.CommandContext(ctx, "bash", "-c", cmd)
+    // Arguments are passed straight to ffmpeg rather than through bash, since URLs and paths can contain anything
+    c := exec.CommandContext(ctx, "ffmpeg", args...)
 
     // Stderr for ffmpeg error messages
     c.Stderr = os.Stderr
     
     // Obtain the pipes that this program will communicate with
-    cstdin, err := c.StdinPipe()
-    if err != nil {
-        return nil, fmt.Errorf("getting stdin: %s", err.Error())
+    var cstdin io.WriteCloser
+    var err error
+    if piped {
+        cstdin, err = c.StdinPipe()
+        if err != nil {
+            return nil, fmt.Errorf("getting stdin: %s", err.Error())
+        }
     }
     cstdout, err := c.StdoutPipe()
     if err != nil {
@@ -40,10 +66,12 @@ func convert_m4a_pcm(audio_stream io.ReadCloser, ctx context.Context) (io.ReadCl
     log.Printf("started ffmpeg command\n")
 
     // In another thread, copy audio stream from youtube into ffmpeg's input directly
-    go func() {
-        io.Copy(cstdin, audio_stream)
-        cstdin.Close()
-    }()
+    if piped {
+        go func() {
+            io.Copy(cstdin, audio_stream)
+            cstdin.Close()
+        }()
+    }
     
     // Return the stdout reader
     return cstdout, nil
@@ -51,14 +79,62 @@ func convert_m4a_pcm(audio_stream io.ReadCloser, ctx context.Context) (io.ReadCl
 }
 
 
-func pcm_bts(byte_stream io.ReadCloser, short_chan chan []int16, guild_id string) (error) {
+// Builds the ffmpeg arguments for decoding a stream to PCM, and whether the stream has to be piped into ffmpeg
+// Using pipes for stdin and stdout removes the need to write any data to a file on the disk
+// The input format is not specified so ffmpeg can probe it, this lets any source (m4a, webm, mp3, flac, ogg, ...) share this path
+func pcm_args(audio_stream io.ReadCloser, start time.Duration, graph string) ([]string, bool) {
+    var args []string
+    var filters []string
+
+    // Starting partway through a stream ffmpeg can open by itself seeks before the input, which only reads from around the start
+    // Otherwise a pipe can not be seeked, so the start is cut off by the filter graph, which decodes and throws away everything before it
+    // Either way this happens before any other filters, so the offset is in the track's own time even when a filter changes the speed
+    input := seekable_input(audio_stream)
+    piped := start == 0 || input == nil
+    if piped {
+        args = append(args, "-i", "pipe:0")
+        if start > 0 {
+            filters = append(filters, fmt.Sprintf("atrim=start=%s,asetpts=PTS-STARTPTS", ffmpeg_duration(start)))
+        }
+    } else {
+        args = append(args, "-ss", ffmpeg_duration(start))
+        args = append(args, input...)
+    }
+
+    if graph != "" {
+        filters = append(filters, graph)
+    }
+    if len(filters) > 0 {
+        args = append(args, "-af", strings.Join(filters, ","))
+    }
+    args = append(args, "-f", "s16le", "-ar", "48000", "-ac", "2", "pipe:1")
+    return args, piped
+}
+
+
+// Returns the ffmpeg input options to open a stream directly, or nil if it can only be piped in
+func seekable_input(audio_stream io.ReadCloser) []string {
+    switch s := audio_stream.(type) {
+    case *resilient_stream:
+        return s.ffmpeg_input()
+    case *os.File:
+        return []string{"-i", s.Name()}
+    }
+    return nil
+}
+
+
+func pcm_bts(byte_stream io.ReadCloser, short_chan chan []int16, pb *playback) (error) {
     var reading bool = true
 
+    // Closing the channel tells the encoding thread there is nothing more to come, once it has sent what is left
+    defer close(short_chan)
+
     // While we should still be reading from ffmpeg
     for reading {
         // Make sure this function has not been cancelled
         select {
-        case <- calls[guild_id].bts_ctx.Done():
+        case <- pb.bts_ctx.Done():
             log.Printf("bts cancelled check 1\n")
             return nil
         default:
@@ -71,12 +147,12 @@ func pcm_bts(byte_stream io.ReadCloser, short_chan chan []int16, guild_id string
             // if we got to EOF, break out of the loop
             if err == io.EOF || err == io.ErrUnexpectedEOF {
                 log.Printf("EOF reached in FFMPEG\n")
-                calls[guild_id].eas_cancel(fmt.Errorf("Song finished"))
-                calls[guild_id].ffm_cancel()
+                pb.ffm_cancel()
                 return nil
 
             // otherwise, there was an actual problem
             } else if err != nil {
+                pb.eas_cancel(fmt.Errorf("Error decoding audio"))
                 return err
             }
 
@@ -87,7 +163,7 @@ func pcm_bts(byte_stream io.ReadCloser, short_chan chan []int16, guild_id string
             case short_chan <- buf:
                 continue
             // Check if this thread was cancelled via context
-            case <- calls[guild_id].bts_ctx.Done():
+            case <- pb.bts_ctx.Done():
                 log.Printf("bts cancelled check 2\n")
                 return nil
             }
@@ -97,3 +173,148 @@ func pcm_bts(byte_stream io.ReadCloser, short_chan chan []int16, guild_id string
     return nil
 }
 
+
+
+// Uses ffprobe to read the duration and tags of a file or URL without decoding it
+func probe_media(input string, ctx context.Context) (ProbeResult, error) {
+    result := ProbeResult{tags: map[string]string{}}
+
+    // Tags can live on the container (mp3, flac) or on the audio stream (ogg), so ask for both
+    c := exec.CommandContext(ctx, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", input)
+    out, err := c.Output()
+    if err != nil {
+        return result, fmt.Errorf("ffprobe: %s", err.Error())
+    }
+
+    var data struct {
+        Format struct {
+            FormatName string `json:"format_name"`
+            Duration string `json:"duration"`
+            Tags map[string]string `json:"tags"`
+        } `json:"format"`
+        Streams []struct {
+            CodecType string `json:"codec_type"`
+            Tags map[string]string `json:"tags"`
+        } `json:"streams"`
+    }
+    err = json.Unmarshal(out, &data)
+    if err != nil {
+        return result, fmt.Errorf("decoding ffprobe output: %s", err.Error())
+    }
+
+    for _, stream := range data.Streams {
+        if stream.CodecType != "audio" {
+            continue
+        }
+        for k, v := range stream.Tags {
+            result.tags[strings.ToLower(k)] = v
+        }
+    }
+    for k, v := range data.Format.Tags {
+        result.tags[strings.ToLower(k)] = v
+    }
+
+    // Duration is missing for things like live streams
+    secs, err := strconv.ParseFloat(data.Format.Duration, 64)
+    if err == nil {
+        result.duration = time.Duration(secs * float64(time.Second))
+    }
+    result.format_name = data.Format.FormatName
+
+    return result, nil
+}
+
+
+// Tries to open a track for opus passthrough, returning a nil reader if it has to be transcoded instead
+// The first packet is read here to make sure the stream really is usable before committing to it
+func open_passthrough(track *Track) (OpusReader, []byte) {
+    // A cached copy of the track needs nothing from the network at all
+    reader := open_cached(track)
+
+    if reader == nil {
+        src, ok := track.source.(opus_source)
+        if !ok {
+            return nil, nil
+        }
+
+        var err error
+        reader, err = src.open_opus()
+        if err != nil {
+            log.Printf("opus passthrough unavailable: %s\n", err.Error())
+            return nil, nil
+        }
+        if reader == nil {
+            return nil, nil
+        }
+    }
+
+    // Discord's sender assumes every packet is one 20ms frame, anything else would play at the wrong speed
+    first, err := reader.read_packet()
+    if err == nil {
+        var dur time.Duration
+        dur, err = opus_packet_duration(first)
+        if err == nil && dur != audio_frame_duration {
+            err = fmt.Errorf("packets are %v long", dur)
+        }
+    }
+
+    // Every packet is the same length, so starting partway through is just a matter of skipping packets
+    for skip := int(track.start / audio_frame_duration); err == nil && skip > 0; skip-- {
+        first, err = reader.read_packet()
+    }
+    if err != nil {
+        log.Printf("opus passthrough unavailable: %s\n", err.Error())
+        reader.Close()
+        return nil, nil
+    }
+
+    return reader, first
+}
+
+
+// Sends opus packets straight to discord, this replaces both pcm_bts and the encoding thread
+func send_opus(reader OpusReader, first []byte, pb *playback, cache_w *cache_writer) error {
+    packet := first
+    for {
+        if !wait_if_paused(pb.pause, pb.vc, pb.eas_ctx) {
+            log.Printf("opus send cancelled while paused\n")
+            return nil
+        }
+
+        // Packets can not have their volume changed, so restart the track as transcoded audio from this point
+        // That leaves a short gap, so it is only done once the sound really has to change, turning on crossfade waits for the next track
+        if changes_sound(get_guild_settings(pb.guild_id)) {
+            position := pb.position()
+            log.Printf("leaving opus passthrough at %s\n", position)
+            pb.eas_cancel(&seek_request{position: position})
+            return nil
+        }
+
+        // Send to discord if the thread has not been cancelled
+        select {
+        case <- pb.eas_ctx.Done():
+            log.Printf("opus send cancelled\n")
+            return nil
+        case pb.vc.opus_send() <- packet:
+        }
+        pb.sent.Add(1)
+        if cache_w != nil {
+            cache_w.write_packet(packet)
+        }
+
+        var err error
+        packet, err = reader.read_packet()
+
+        // if we got to EOF, the song is done
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            log.Printf("EOF reached in opus stream\n")
+            pb.eas_cancel(err_song_finished)
+            return nil
+
+        // otherwise, there was an actual problem
+        } else if err != nil {
+            pb.eas_cancel(fmt.Errorf("Error reading stream"))
+            return err
+        }
+    }
+}
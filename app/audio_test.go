@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPcmArgs(t *testing.T) {
+    pipe := io.NopCloser(strings.NewReader("audio"))
+    ranged := &resilient_stream{url: "https://example.com/videoplayback?id=1&range=x"}
+    file, err := os.Create(filepath.Join(t.TempDir(), "song.mp3"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+
+    cases := []struct {
+        name string
+        stream io.ReadCloser
+        start time.Duration
+        expected string
+        piped bool
+    }{
+        {"pipe from the start", pipe, 0, "-i pipe:0 -af volume=0.5 -f s16le -ar 48000 -ac 2 pipe:1", true},
+        // Only a pipe has to decode everything before the start
+        {"pipe seeking", pipe, 90 * time.Second, "-i pipe:0 -af atrim=start=90.000,asetpts=PTS-STARTPTS,volume=0.5 -f s16le -ar 48000 -ac 2 pipe:1", true},
+        {"ranged from the start", ranged, 0, "-i pipe:0 -af volume=0.5 -f s16le -ar 48000 -ac 2 pipe:1", true},
+        {"ranged seeking", ranged, 90 * time.Second, "-ss 90.000 -headers Origin: https://youtube.com\r\n -reconnect 1 -reconnect_delay_max 5 -i " + ranged.url + " -af volume=0.5 -f s16le -ar 48000 -ac 2 pipe:1", false},
+        {"file seeking", file, 90 * time.Second, "-ss 90.000 -i " + file.Name() + " -af volume=0.5 -f s16le -ar 48000 -ac 2 pipe:1", false},
+    }
+    for _, c := range cases {
+        args, piped := pcm_args(c.stream, c.start, "volume=0.5")
+        if strings.Join(args, " ") != c.expected || piped != c.piped {
+            t.Errorf("%s gave %q, %v", c.name, args, piped)
+        }
+    }
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encoded Opus packets saved to disk as Ogg Opus files, so popular tracks skip the download / ffmpeg / encode pipeline
+// Files are named after a hash of the track ID and encoder settings, and the least recently used ones are evicted first
+type cache_entry struct {
+    size int64
+    last_used time.Time
+}
+
+// Collects the packets of a track as they are sent, and only adds them to the cache if the whole track was played
+type cache_writer struct {
+    key string
+    file *os.File
+    buf *bufio.Writer
+    ogg *ogg_opus_writer
+    err error
+}
+
+var (
+    cache_index = map[string]cache_entry{}
+    cache_size int64
+    cache_mutx sync.Mutex
+)
+
+const (
+    cache_ext string = ".opus"
+    cache_tmp_ext string = ".tmp"
+    // How much shorter than its listed duration a track can be and still be cached, youtube rounds durations
+    cache_duration_tolerance time.Duration = 2 * time.Second
+)
+
+
+// Returns the cache key for a track, or an empty string if the track should not be cached
+// Only youtube tracks have IDs that are stable enough, and live streams never end
+func cache_key(track *Track) string {
+    if settings.cache_dir == "" || track.live || !strings.HasPrefix(track.id, "yt:") {
+        return ""
+    }
+    // Packets encoded with different settings are not interchangeable
+    sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%d|%d", track.id, audio_sample_rate, audio_chan, audio_frame_size, audio_bitrate)))
+    return hex.EncodeToString(sum[:])
+}
+
+
+func cache_path(key string) string {
+    return filepath.Join(settings.cache_dir, key+cache_ext)
+}
+
+
+// Builds the index from the files already in the cache directory
+// Modification times are used as the last used time, so the LRU order survives restarts
+func init_cache() error {
+    entries, err := os.ReadDir(settings.cache_dir)
+    if err != nil {
+        return err
+    }
+
+    cache_mutx.Lock()
+    defer cache_mutx.Unlock()
+
+    for _, e := range entries {
+        name := e.Name()
+
+        // Left over from a track that was being written when the bot stopped
+        if strings.HasSuffix(name, cache_tmp_ext) {
+            os.Remove(filepath.Join(settings.cache_dir, name))
+            continue
+        }
+        if !strings.HasSuffix(name, cache_ext) {
+            continue
+        }
+
+        info, err := e.Info()
+        if err != nil {
+            continue
+        }
+        cache_index[strings.TrimSuffix(name, cache_ext)] = cache_entry{size: info.Size(), last_used: info.ModTime()}
+        cache_size += info.Size()
+    }
+
+    log.Printf("cache: %d tracks, %d MB\n", len(cache_index), cache_size/(1024*1024))
+    evict_cache()
+    return nil
+}
+
+
+// Removes the least recently used files until the cache fits in its size limit
+// Must be called with cache_mutx held
+func evict_cache() {
+    if cache_size <= settings.cache_max_bytes {
+        return
+    }
+
+    keys := make([]string, 0, len(cache_index))
+    for key := range cache_index {
+        keys = append(keys, key)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        return cache_index[keys[i]].last_used.Before(cache_index[keys[j]].last_used)
+    })
+
+    for _, key := range keys {
+        if cache_size <= settings.cache_max_bytes {
+            break
+        }
+        remove_cache_entry(key)
+        log.Printf("cache: evicted %s\n", key)
+    }
+}
+
+
+// Must be called with cache_mutx held
+func remove_cache_entry(key string) {
+    entry, exists := cache_index[key]
+    if !exists {
+        return
+    }
+    err := os.Remove(cache_path(key))
+    if err != nil && !os.IsNotExist(err) {
+        log.Printf("cache: removing %s: %s\n", key, err.Error())
+    }
+    cache_size -= entry.size
+    delete(cache_index, key)
+}
+
+
+// Opens a cached copy of a track if there is one, returning a nil reader otherwise
+func open_cached(track *Track) OpusReader {
+    key := cache_key(track)
+    if key == "" {
+        return nil
+    }
+
+    // Only the index is touched with the lock held, so other guilds are not held up while the file is read
+    // Mark as recently used straight away, so the file is not evicted while it is being read
+    cache_mutx.Lock()
+    entry, exists := cache_index[key]
+    now := time.Now()
+    if exists {
+        entry.last_used = now
+        cache_index[key] = entry
+    }
+    cache_mutx.Unlock()
+    if !exists {
+        return nil
+    }
+
+    // The whole file is read and checked up front, so a corrupt file never gets partway through playing
+    data, err := os.ReadFile(cache_path(key))
+    if err == nil && int64(len(data)) != entry.size {
+        err = fmt.Errorf("size changed from %d to %d", entry.size, len(data))
+    }
+    var reader *ogg_opus_reader
+    if err == nil {
+        reader, err = read_ogg_opus(data)
+    }
+    if err != nil {
+        log.Printf("cache: dropping bad entry for %s: %s\n", track.id, err.Error())
+        cache_mutx.Lock()
+        // Leave it alone if another guild replaced it in the meantime
+        if current, exists := cache_index[key]; exists && current.size == entry.size {
+            remove_cache_entry(key)
+        }
+        cache_mutx.Unlock()
+        return nil
+    }
+
+    // Keep the on disk time in step with the index, so the LRU order survives restarts
+    os.Chtimes(cache_path(key), now, now)
+
+    log.Printf("cache: hit for %s\n", track.id)
+    return reader
+}
+
+
+// Starts saving the packets of a track, returning nil if the track can not be cached or already is
+func start_cache_write(track *Track) *cache_writer {
+    key := cache_key(track)
+    if key == "" {
+        return nil
+    }
+
+    cache_mutx.Lock()
+    _, exists := cache_index[key]
+    cache_mutx.Unlock()
+    if exists {
+        return nil
+    }
+
+    // Unique temporary name, in case the same track is playing in more than one guild
+    f, err := os.CreateTemp(settings.cache_dir, key+"-*"+cache_tmp_ext)
+    if err != nil {
+        log.Printf("cache: unable to create file: %s\n", err.Error())
+        return nil
+    }
+
+    c := &cache_writer{key: key, file: f, buf: bufio.NewWriter(f)}
+    c.ogg, c.err = new_ogg_opus_writer(c.buf, uint32(time.Now().UnixNano()))
+    return c
+}
+
+
+func (c *cache_writer) write_packet(packet []byte) {
+    if c.err != nil {
+        return
+    }
+    c.err = c.ogg.write_packet(packet)
+}
+
+
+// Marks the track as not worth keeping, e.g. because its volume was changed, without stopping the writes
+func (c *cache_writer) invalidate(reason string) {
+    if c.err == nil {
+        c.err = fmt.Errorf("%s", reason)
+    }
+}
+
+
+// Throws away a partially written track, e.g. after a skip
+func (c *cache_writer) abort() {
+    c.file.Close()
+    os.Remove(c.file.Name())
+}
+
+
+// Adds a fully played track to the cache, as long as it is about as long as the track should be
+func (c *cache_writer) commit(expected time.Duration) {
+    err := c.err
+    if err == nil {
+        written := time.Duration(c.ogg.granule) * time.Second / time.Duration(audio_sample_rate)
+        if expected > 0 && written < expected-cache_duration_tolerance {
+            err = fmt.Errorf("only %v of %v was written", written, expected)
+        }
+    }
+    if err == nil {
+        err = c.ogg.finish()
+    }
+    if err == nil {
+        err = c.buf.Flush()
+    }
+    if err == nil {
+        err = c.file.Sync()
+    }
+    if err != nil {
+        log.Printf("cache: unable to write %s: %s\n", c.key, err.Error())
+        c.abort()
+        return
+    }
+
+    info, err := c.file.Stat()
+    c.file.Close()
+    if err != nil {
+        os.Remove(c.file.Name())
+        return
+    }
+
+    cache_mutx.Lock()
+    defer cache_mutx.Unlock()
+
+    // Replace any entry written by another guild in the meantime
+    remove_cache_entry(c.key)
+    err = os.Rename(c.file.Name(), cache_path(c.key))
+    if err != nil {
+        log.Printf("cache: unable to save %s: %s\n", c.key, err.Error())
+        os.Remove(c.file.Name())
+        return
+    }
+
+    cache_index[c.key] = cache_entry{size: info.Size(), last_used: time.Now()}
+    cache_size += info.Size()
+    log.Printf("cache: saved %s (%d KB)\n", c.key, info.Size()/1024)
+
+    evict_cache()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Points the cache at an empty directory for one test
+func use_cache(t *testing.T, max_bytes int64) string {
+    dir := t.TempDir()
+    set_test_settings(t, func(s *Settings) {
+        s.cache_dir = dir
+        s.cache_max_bytes = max_bytes
+    })
+
+    cache_mutx.Lock()
+    old_index, old_size := cache_index, cache_size
+    cache_index, cache_size = map[string]cache_entry{}, 0
+    cache_mutx.Unlock()
+
+    t.Cleanup(func() {
+        cache_mutx.Lock()
+        cache_index, cache_size = old_index, old_size
+        cache_mutx.Unlock()
+    })
+    return dir
+}
+
+
+// Plays a track of the given number of packets into the cache
+func write_test_cache(t *testing.T, id string, packets int, expected time.Duration) {
+    t.Helper()
+    c := start_cache_write(&Track{id: id})
+    if c == nil {
+        t.Fatalf("%s could not be cached", id)
+    }
+    for i := 0; i < packets; i++ {
+        c.write_packet([]byte{0xFC, byte(i), 0x01, 0x02})
+    }
+    c.commit(expected)
+}
+
+
+func is_cached(id string) bool {
+    cache_mutx.Lock()
+    defer cache_mutx.Unlock()
+    _, exists := cache_index[cache_key(&Track{id: id})]
+    return exists
+}
+
+
+func test_ogg_file(t *testing.T, packets [][]byte) []byte {
+    t.Helper()
+    var buf bytes.Buffer
+    o, err := new_ogg_opus_writer(&buf, 1234)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, p := range packets {
+        if err := o.write_packet(p); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := o.finish(); err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes()
+}
+
+
+func TestOggRoundTrip(t *testing.T) {
+    // Sizes around the 255 byte lacing boundaries, and enough packets to need several pages
+    var packets [][]byte
+    for _, size := range []int{1, 254, 255, 256, 510, 1000, 3} {
+        packets = append(packets, bytes.Repeat([]byte{byte(size)}, size))
+    }
+    for i := 0; i < 120; i++ {
+        packets = append(packets, []byte{0xFC, byte(i)})
+    }
+
+    reader, err := read_ogg_opus(test_ogg_file(t, packets))
+    if err != nil {
+        t.Fatalf("read: %v", err)
+    }
+    for i, expected := range packets {
+        p, err := reader.read_packet()
+        if err != nil || !bytes.Equal(p, expected) {
+            t.Fatalf("packet %d was %d bytes, %v, expected %d bytes", i, len(p), err, len(expected))
+        }
+    }
+    if _, err := reader.read_packet(); err == nil {
+        t.Fatalf("packets left over at the end")
+    }
+
+    // A packet too big for one page is refused rather than written wrongly
+    o, _ := new_ogg_opus_writer(&bytes.Buffer{}, 1)
+    if err := o.write_packet(make([]byte, 255*255)); err == nil {
+        t.Fatalf("an oversized packet was accepted")
+    }
+}
+
+
+func TestOggCorrupted(t *testing.T) {
+    data := test_ogg_file(t, [][]byte{[]byte("first"), []byte("second")})
+
+    // Any changed byte, whether in a header or a packet, fails the page's CRC
+    for _, pos := range []int{10, len(data) - 3} {
+        corrupt := bytes.Clone(data)
+        corrupt[pos] ^= 0x40
+        if _, err := read_ogg_opus(corrupt); err == nil {
+            t.Errorf("a flipped byte at %d was not noticed", pos)
+        }
+    }
+
+    // So does a file cut short, even exactly between pages
+    if _, err := read_ogg_opus(data[:len(data)-1]); err == nil {
+        t.Errorf("a cut off page was not noticed")
+    }
+    first_pages := test_ogg_file(t, nil)
+    if _, err := read_ogg_opus(data[:len(first_pages)-ogg_header_size]); err == nil {
+        t.Errorf("a file with no end was not noticed")
+    }
+}
+
+
+func TestCacheCommitTolerance(t *testing.T) {
+    dir := use_cache(t, 1<<30)
+
+    // 4 seconds short of its listed length, so cut off early rather than rounded
+    write_test_cache(t, "yt:short", 50, 5*time.Second)
+    if is_cached("yt:short") {
+        t.Fatalf("a track cut short was cached")
+    }
+
+    // Within the tolerance for rounded durations
+    write_test_cache(t, "yt:rounded", 50*4, 5*time.Second)
+    if !is_cached("yt:rounded") {
+        t.Fatalf("a track with a rounded duration was not cached")
+    }
+
+    // Only the one saved file is left, the aborted one is cleaned up
+    files, _ := filepath.Glob(filepath.Join(dir, "*"))
+    if len(files) != 1 || filepath.Ext(files[0]) != cache_ext {
+        t.Fatalf("cache directory has %v", files)
+    }
+
+    reader := open_cached(&Track{id: "yt:rounded"})
+    if reader == nil {
+        t.Fatalf("the cached track could not be opened")
+    }
+    p, err := reader.read_packet()
+    if err != nil || !bytes.Equal(p, []byte{0xFC, 0, 0x01, 0x02}) {
+        t.Fatalf("first cached packet was %v, %v", p, err)
+    }
+}
+
+
+func TestCacheEvictionOrder(t *testing.T) {
+    use_cache(t, 1<<30)
+    write_test_cache(t, "yt:a", 10, 0)
+    write_test_cache(t, "yt:b", 10, 0)
+    write_test_cache(t, "yt:c", 10, 0)
+
+    // Playing a makes b the least recently used
+    if open_cached(&Track{id: "yt:a"}) == nil {
+        t.Fatalf("a was not cached")
+    }
+
+    // Room for three tracks, so adding a fourth evicts one
+    cache_mutx.Lock()
+    settings.cache_max_bytes = cache_size
+    cache_mutx.Unlock()
+    write_test_cache(t, "yt:d", 10, 0)
+
+    for id, expected := range map[string]bool{"yt:a": true, "yt:b": false, "yt:c": true, "yt:d": true} {
+        if is_cached(id) != expected {
+            t.Errorf("%s cached: %v, expected %v", id, !expected, expected)
+        }
+    }
+    if _, err := os.Stat(cache_path(cache_key(&Track{id: "yt:b"}))); !os.IsNotExist(err) {
+        t.Errorf("the evicted file is still there")
+    }
+
+    // A corrupted file is dropped when it is next opened
+    path := cache_path(cache_key(&Track{id: "yt:c"}))
+    data, _ := os.ReadFile(path)
+    data[len(data)-2] ^= 0xFF
+    os.WriteFile(path, data, 0644)
+    if open_cached(&Track{id: "yt:c"}) != nil || is_cached("yt:c") {
+        t.Fatalf("a corrupted file was played")
+    }
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/kkdai/youtube/v2"
+)
+
+// A file format that +dl can convert the audio into
+type DownloadFormat struct {
+    ext string
+    // ffmpeg muxer and audio encoder
+    muxer string
+    codec string
+    // Extra ffmpeg output options
+    args []string
+    // Default and lowest bitrate in kbps, 0 for lossless formats which can not be made smaller
+    bitrate int
+    min_bitrate int
+    // Smallest a second of audio is likely to be for lossless formats, so files that can not fit are turned down before converting
+    bytes_per_sec int64
+    // Whether the container can hold cover art
+    cover bool
+}
+
+var (
+    download_formats = map[string]DownloadFormat{
+        "mp3": {
+            ext: "mp3",
+            muxer: "mp3",
+            codec: "libmp3lame",
+            // ID3v2.3 is the version most players understand
+            args: []string{"-id3v2_version", "3"},
+            bitrate: 192,
+            min_bitrate: 64,
+            cover: true,
+        },
+        "opus": {
+            ext: "opus",
+            muxer: "opus",
+            codec: "libopus",
+            bitrate: 128,
+            min_bitrate: 32,
+        },
+        "flac": {
+            ext: "flac",
+            muxer: "flac",
+            codec: "flac",
+            // FLAC rarely gets music much under half the size of the raw audio
+            bytes_per_sec: 48000 * 2 * 2 / 2,
+            cover: true,
+        },
+        "wav": {
+            ext: "wav",
+            muxer: "wav",
+            codec: "pcm_s16le",
+            args: []string{"-ar", "48000", "-ac", "2"},
+            bytes_per_sec: 48000 * 2 * 2,
+        },
+    }
+
+    thumbnail_client = &http.Client{Timeout: 10 * time.Second}
+)
+
+// What +dl should do with the audio, from the options given along with the link or search
+type DownloadOptions struct {
+    format string
+    // Part of the video to keep, end is 0 when the whole video is wanted
+    start time.Duration
+    end time.Duration
+    fade_in time.Duration
+    fade_out time.Duration
+}
+
+const (
+    // Discord's upload limit for servers without boosts, and for the boost tiers that raise it
+    upload_limit_default int64 = 10 * 1024 * 1024
+    upload_limit_tier2 int64 = 50 * 1024 * 1024
+    upload_limit_tier3 int64 = 100 * 1024 * 1024
+    // Room left for the message and form data sent along with the file
+    upload_overhead_bytes int64 = 64 * 1024
+
+    // Encoders overshoot their target bitrate a little, so aim for slightly under the limit
+    download_bitrate_headroom float64 = 0.92
+    // Longest a download is allowed to take, including converting it
+    download_timeout time.Duration = 10 * time.Minute
+    // Anything bigger than this is not a thumbnail
+    thumbnail_max_bytes int64 = 5 * 1024 * 1024
+    filename_max_len int = 100
+
+    // Clips have to be converted, so they use this format when none is given
+    clip_default_format string = "mp3"
+    // Used by fade options that do not give a length
+    default_fade time.Duration = 2 * time.Second
+)
+
+
+func download_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
+    argument, opts, err := parse_download_args(cmd_argument(m.Content))
+    if err != nil {
+        send_message(s, m.ChannelID, err.Error())
+        return
+    }
+
+    // Make sure command is formatted correctly
+    if argument == "" {
+        send_message(s, m.ChannelID, fmt.Sprintf("invalid syntax: use `%cdl [link or search] [--range start-end] [--fade|--fadein|--fadeout[=seconds]] [--format mp3|opus|flac|wav]`", settings.cmd_prefix))
+        return
+    }
+
+    // Get the file and upload it to discord
+    get_file(s, m, argument, opts)
+}
+
+
+// Splits a +dl argument into the link or search and its options, which can be anywhere in it
+// Options are marked with dashes, so search words like "1999-2001" or "opus" are never mistaken for them
+func parse_download_args(argument string) (string, DownloadOptions, error) {
+    var opts DownloadOptions
+    var query []string
+
+    fields := strings.Fields(argument)
+    for i := 0; i < len(fields); i++ {
+        word := fields[i]
+        name, value, has_value := strings.Cut(word, "=")
+        name = strings.ToLower(name)
+
+        // Options that need a value can also take it from the next word, e.g. -f mp3
+        if !has_value && download_option_needs_value(name) && i+1 < len(fields) {
+            i++
+            value, has_value = fields[i], true
+        }
+
+        ok, err := parse_download_option(name, value, has_value, &opts)
+        if err != nil {
+            return "", opts, err
+        }
+        if !ok {
+            // A single dash is common enough in searches, but a double dash can only be a mistyped option
+            if strings.HasPrefix(word, "--") {
+                return "", opts, fmt.Errorf("unknown option '%s'", word)
+            }
+            query = append(query, word)
+        }
+    }
+
+    // There is nothing to search for after a link, so words after it can only be a bare format or range like `link mp3 1:23-2:05`
+    // Anything else would be silently ignored when the video ID is read from the link, so it is an error instead
+    if len(query) > 1 && is_link(query[0]) {
+        for _, word := range query[1:] {
+            name := "--range"
+            if _, exists := download_formats[strings.ToLower(word)]; exists {
+                name = "--format"
+            }
+            _, err := parse_download_option(name, word, true, &opts)
+            if err != nil {
+                return "", opts, err
+            }
+        }
+        query = query[:1]
+    }
+    return strings.Join(query, " "), opts, nil
+}
+
+
+func download_option_needs_value(name string) bool {
+    return name == "-f" || name == "--format" || name == "-r" || name == "--range"
+}
+
+
+// Fills in one +dl option, returning false if the name is not an option at all so it can be treated as part of the search
+func parse_download_option(name string, value string, has_value bool, opts *DownloadOptions) (bool, error) {
+    if download_option_needs_value(name) && !has_value {
+        return false, fmt.Errorf("'%s' needs a value", name)
+    }
+
+    switch name {
+    case "-f", "--format":
+        value = strings.ToLower(value)
+        if _, exists := download_formats[value]; !exists {
+            return false, fmt.Errorf("unknown format '%s', use mp3, opus, flac or wav", value)
+        }
+        opts.format = value
+
+    // Fades, optionally with a length in seconds like --fade=3
+    case "--fade", "--fadein", "--fadeout":
+        length := default_fade
+        if has_value {
+            secs, err := strconv.ParseFloat(value, 64)
+            if err != nil || math.IsNaN(secs) || secs <= 0 || secs > 60 {
+                return false, fmt.Errorf("invalid fade length '%s', use a number of seconds up to 60", value)
+            }
+            length = time.Duration(secs * float64(time.Second))
+        }
+        if name != "--fadeout" {
+            opts.fade_in = length
+        }
+        if name != "--fadein" {
+            opts.fade_out = length
+        }
+
+    // Time ranges look like 1:23-2:05, leaving out the end keeps everything after the start
+    case "-r", "--range":
+        invalid := fmt.Errorf("invalid time range '%s', use start-end like 1:23-2:05", value)
+        from, to, found := strings.Cut(value, "-")
+        if !found {
+            return false, invalid
+        }
+        start, err := parse_timestamp(from)
+        if err != nil {
+            return false, invalid
+        }
+        var end time.Duration
+        if to != "" {
+            end, err = parse_timestamp(to)
+            if err != nil {
+                return false, invalid
+            }
+            if end <= start {
+                return false, fmt.Errorf("invalid time range '%s', the end has to be after the start", value)
+            }
+        }
+        opts.start = start
+        opts.end = end
+
+    default:
+        return false, nil
+    }
+    return true, nil
+}
+
+
+func get_file(s *discordgo.Session, m *discordgo.MessageCreate, argument string, opts DownloadOptions) {
+    // Get the video based on the argument
+    video, err := get_video(argument)
+    if err != nil {
+        log.Printf("failed to get video: %s\n", err.Error())
+        send_message(s, m.ChannelID, youtube_error_message(err, "video"))
+        return
+    }
+
+    // Check the time range against the video before downloading anything
+    ranged := opts.start > 0 || opts.end > 0
+    duration := video.Duration
+    if ranged || opts.fade_in > 0 || opts.fade_out > 0 {
+        if opts.end == 0 {
+            opts.end = video.Duration
+        }
+        if video.Duration > 0 && (opts.end > video.Duration || opts.start >= opts.end) {
+            send_message(s, m.ChannelID, fmt.Sprintf("%s is only %s long", video.Title, video.Duration.String()))
+            return
+        }
+        if opts.end > 0 {
+            duration = opts.end - opts.start
+        }
+        if duration > 0 && opts.fade_in+opts.fade_out > duration {
+            send_message(s, m.ChannelID, "The fades are longer than the clip")
+            return
+        }
+        // Cutting and fading means converting, even if no format was asked for
+        if opts.format == "" {
+            opts.format = clip_default_format
+        }
+    }
+    format_name := opts.format
+
+    // Converting can take a while, so show that something is happening
+    s.ChannelTyping(m.ChannelID)
+    limit := upload_limit(s, m.GuildID)
+    name := sanitize_filename(video.Title)
+    if ranged {
+        name = sanitize_filename(fmt.Sprintf("%s (%s-%s)", video.Title, opts.start.Round(time.Second), opts.end.Round(time.Second)))
+    }
+
+    // Work out whether the file can fit before downloading or converting anything
+    bitrate := 0
+    if format_name != "" {
+        bitrate, err = download_bitrate(download_formats[format_name], duration, limit)
+        if err != nil {
+            send_message(s, m.ChannelID, fmt.Sprintf("%s %s", video.Title, err.Error()))
+            return
+        }
+    }
+
+    // Get the stream based on the argument
+    stream, format, err := get_audio_stream(video)
+    if err != nil {
+        log.Printf("failed to get audio stream: %s\n", err.Error())
+        send_message(s, m.ChannelID, youtube_error_message(err, "video"))
+        return
+    }
+    defer stream.Close()
+
+    // Without an output format the stream is sent as it is, named after the container of the selected format
+    if format_name == "" {
+        if format.ContentLength > limit {
+            send_message(s, m.ChannelID, fmt.Sprintf("The audio for %s is %s, over this server's %s upload limit. Try `%cdl [link] --format opus` for a smaller file",
+                video.Title, format_size(format.ContentLength), format_size(limit), settings.cmd_prefix))
+            return
+        }
+        upload_file(s, m.ChannelID, fmt.Sprintf("Here is the audio for %s", video.Title), name+"."+format_extension(format), stream)
+        return
+    }
+
+    out := download_formats[format_name]
+
+    ctx, cancel := context.WithTimeout(context.Background(), download_timeout)
+    defer cancel()
+
+    dir, err := os.MkdirTemp("", "discord_tunes-dl-*")
+    if err != nil {
+        log.Printf("creating download dir: %s\n", err.Error())
+        send_message(s, m.ChannelID, "Unable to convert audio")
+        return
+    }
+    defer os.RemoveAll(dir)
+
+    // Save the source first, so it can be converted again at a lower bitrate without downloading it twice
+    src := filepath.Join(dir, "source."+format_extension(format))
+    err = save_file(stream, src)
+    if err != nil {
+        log.Printf("saving audio stream: %s\n", err.Error())
+        send_message(s, m.ChannelID, fmt.Sprintf("Unable to download audio for %s", video.Title))
+        return
+    }
+
+    cover := ""
+    if out.cover {
+        cover = download_thumbnail(video, dir)
+    }
+    tags := map[string]string{
+        "title": video.Title,
+        "artist": video.Author,
+        "comment": "https://www.youtube.com/watch?v=" + video.ID,
+    }
+
+    dst := filepath.Join(dir, name+"."+out.ext)
+    for {
+        err = transcode_file(src, dst, out, bitrate, tags, cover, opts, ctx)
+        if err != nil {
+            log.Printf("converting %s to %s: %s\n", video.ID, format_name, err.Error())
+            send_message(s, m.ChannelID, fmt.Sprintf("Unable to convert %s to %s", video.Title, format_name))
+            return
+        }
+
+        info, err := os.Stat(dst)
+        if err != nil {
+            log.Printf("checking converted file: %s\n", err.Error())
+            send_message(s, m.ChannelID, fmt.Sprintf("Unable to convert %s to %s", video.Title, format_name))
+            return
+        }
+        if info.Size() <= limit {
+            break
+        }
+
+        // Lossless formats can not be made any smaller
+        if out.bitrate == 0 {
+            send_message(s, m.ChannelID, fmt.Sprintf("%s is %s as %s, over this server's %s upload limit. Try mp3 or opus instead",
+                video.Title, format_size(info.Size()), format_name, format_size(limit)))
+            return
+        }
+
+        // The encoder overshot, so aim lower by however much it went over
+        next := int(float64(bitrate) * float64(limit) / float64(info.Size()) * download_bitrate_headroom)
+        if next < out.min_bitrate {
+            send_message(s, m.ChannelID, fmt.Sprintf("%s is too long to fit in this server's %s upload limit as %s", video.Title, format_size(limit), format_name))
+            return
+        }
+        log.Printf("%s was %d bytes at %d kbps, retrying at %d kbps\n", dst, info.Size(), bitrate, next)
+        bitrate = next
+    }
+
+    f, err := os.Open(dst)
+    if err != nil {
+        log.Printf("opening converted file: %s\n", err.Error())
+        send_message(s, m.ChannelID, fmt.Sprintf("Unable to convert %s to %s", video.Title, format_name))
+        return
+    }
+    defer f.Close()
+
+    msg := fmt.Sprintf("Here is the audio for %s", video.Title)
+    if bitrate < out.bitrate {
+        msg += fmt.Sprintf(" (%d kbps to fit the upload limit)", bitrate)
+    }
+    upload_file(s, m.ChannelID, msg, name+"."+out.ext, f)
+}
+
+
+// Picks the bitrate to convert at, or returns why a file of this length can not fit in the upload limit
+// Lossless formats have no bitrate to pick, so they are only checked against their likely size
+func download_bitrate(out DownloadFormat, duration time.Duration, limit int64) (int, error) {
+    if out.bitrate > 0 {
+        fit := fit_bitrate(duration, limit)
+        if fit < out.min_bitrate {
+            return 0, fmt.Errorf("is too long to fit in this server's %s upload limit as %s, try a shorter clip", format_size(limit), out.ext)
+        }
+        return min(fit, out.bitrate), nil
+    }
+
+    estimate := int64(duration.Seconds()) * out.bytes_per_sec
+    if estimate > limit {
+        return 0, fmt.Errorf("would be at least %s as %s, over this server's %s upload limit. Try mp3 or opus instead", format_size(estimate), out.ext, format_size(limit))
+    }
+    return 0, nil
+}
+
+
+// Sends a file along with a message, letting the channel know if it did not work
+func upload_file(s *discordgo.Session, channel_id string, msg string, filename string, r io.Reader) {
+    _, err := s.ChannelMessageSendComplex(channel_id, &discordgo.MessageSend{
+        Content: msg,
+        Files: []*discordgo.File{{Name: filename, Reader: r}},
+    })
+    if err != nil {
+        log.Printf("uploading %s: %s\n", filename, err.Error())
+        send_message(s, channel_id, fmt.Sprintf("Unable to upload %s", filename))
+    }
+}
+
+
+// Sends a message to a channel, logging it if discord would not take it since there is nobody else to tell
+func send_message(s *discordgo.Session, channel_id string, msg string) {
+    _, err := s.ChannelMessageSend(channel_id, msg)
+    if err != nil {
+        log.Printf("sending message to %s: %s\n", channel_id, err.Error())
+    }
+}
+
+
+// Largest file that can be uploaded to a guild, which depends on its boost level
+func upload_limit(s *discordgo.Session, guild_id string) int64 {
+    limit := upload_limit_default
+    if guild_id != "" {
+        guild, err := s.State.Guild(guild_id)
+        if err != nil {
+            guild, err = s.Guild(guild_id)
+        }
+        if err == nil {
+            switch guild.PremiumTier {
+            case discordgo.PremiumTier2:
+                limit = upload_limit_tier2
+            case discordgo.PremiumTier3:
+                limit = upload_limit_tier3
+            }
+        }
+    }
+    return limit - upload_overhead_bytes
+}
+
+
+// Highest bitrate in kbps that keeps a track of the given length under the size limit
+func fit_bitrate(duration time.Duration, limit int64) int {
+    // Without a duration there is nothing to go on, so start at the default and check the size afterwards
+    if duration <= 0 {
+        return int(^uint(0) >> 1)
+    }
+    return int(float64(limit) * 8 / duration.Seconds() / 1000 * download_bitrate_headroom)
+}
+
+
+func format_size(bytes int64) string {
+    return fmt.Sprintf("%.1f MB", float64(bytes)/(1024*1024))
+}
+
+
+// Turns a video title into something that is safe to use as a file name
+func sanitize_filename(title string) string {
+    var b strings.Builder
+    for _, r := range title {
+        switch {
+        case unicode.IsLetter(r) || unicode.IsDigit(r):
+            b.WriteRune(r)
+        case strings.ContainsRune(" -_.,()[]&'", r):
+            b.WriteRune(r)
+        default:
+            b.WriteRune('_')
+        }
+    }
+
+    // Leading dots would hide the file, and trailing ones confuse some systems
+    name := strings.Trim(strings.Join(strings.Fields(b.String()), " "), " ._")
+    if runes := []rune(name); len(runes) > filename_max_len {
+        name = strings.TrimRight(string(runes[:filename_max_len]), " ._")
+    }
+    if name == "" {
+        name = "audio"
+    }
+    return name
+}
+
+
+func save_file(r io.Reader, path string) error {
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(f, r)
+    if err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+
+// Saves the largest thumbnail of a video to use as cover art, returning an empty path if there is none
+func download_thumbnail(video *youtube.Video, dir string) string {
+    if len(video.Thumbnails) == 0 {
+        return ""
+    }
+    best := video.Thumbnails[0]
+    for _, t := range video.Thumbnails[1:] {
+        if t.Width*t.Height > best.Width*best.Height {
+            best = t
+        }
+    }
+
+    resp, err := thumbnail_client.Get(best.URL)
+    if err != nil {
+        log.Printf("downloading thumbnail: %s\n", err.Error())
+        return ""
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        log.Printf("downloading thumbnail: unexpected status %d\n", resp.StatusCode)
+        return ""
+    }
+
+    path := filepath.Join(dir, "cover")
+    err = save_file(io.LimitReader(resp.Body, thumbnail_max_bytes), path)
+    if err != nil {
+        log.Printf("saving thumbnail: %s\n", err.Error())
+        return ""
+    }
+    return path
+}
+
+
+// Converts an audio file with ffmpeg, cutting it to the requested range and adding tags and cover art
+// Arguments are passed straight to ffmpeg rather than through bash, since titles can contain anything
+func transcode_file(input string, output string, out DownloadFormat, bitrate int, tags map[string]string, cover string, opts DownloadOptions, ctx context.Context) error {
+    args := []string{"-y", "-loglevel", "error"}
+
+    // Seeking on the input is fast, and still exact since the audio is being decoded anyway
+    // Timestamps start again from 0 after an input seek, so the fades are relative to the start of the clip
+    if opts.start > 0 {
+        args = append(args, "-ss", ffmpeg_duration(opts.start))
+    }
+    args = append(args, "-i", input)
+    if cover != "" {
+        args = append(args, "-i", cover)
+    }
+
+    // Only keep the audio, plus the cover as an attached picture
+    // Thumbnails are often webp, which most players can not show, so the cover is always converted to jpeg
+    args = append(args, "-map", "0:a:0", "-map_metadata", "-1")
+    if cover != "" {
+        args = append(args, "-map", "1:v:0", "-c:v", "mjpeg", "-disposition:v", "attached_pic")
+    }
+
+    if opts.end > 0 {
+        args = append(args, "-t", ffmpeg_duration(opts.end-opts.start))
+    }
+
+    var filters []string
+    if opts.fade_in > 0 {
+        filters = append(filters, fmt.Sprintf("afade=t=in:st=0:d=%s", ffmpeg_duration(opts.fade_in)))
+    }
+    if opts.fade_out > 0 && opts.end > 0 {
+        filters = append(filters, fmt.Sprintf("afade=t=out:st=%s:d=%s", ffmpeg_duration(opts.end-opts.start-opts.fade_out), ffmpeg_duration(opts.fade_out)))
+    }
+    if len(filters) > 0 {
+        args = append(args, "-af", strings.Join(filters, ","))
+    }
+
+    args = append(args, "-c:a", out.codec)
+    if bitrate > 0 {
+        args = append(args, "-b:a", fmt.Sprintf("%dk", bitrate))
+    }
+    args = append(args, out.args...)
+    for k, v := range tags {
+        if v != "" {
+            args = append(args, "-metadata", k+"="+v)
+        }
+    }
+    args = append(args, "-f", out.muxer, output)
+
+    c := exec.CommandContext(ctx, "ffmpeg", args...)
+    c.Stderr = os.Stderr
+    err := c.Run()
+    if err != nil {
+        return fmt.Errorf("ffmpeg: %s", err.Error())
+    }
+    return nil
+}
+
+
+// Formats a duration as seconds for ffmpeg options
+func ffmpeg_duration(d time.Duration) string {
+    return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDownloadArgs(t *testing.T) {
+    valid := []struct {
+        argument string
+        query string
+        opts DownloadOptions
+    }{
+        // Words that look like formats or ranges stay in the search unless they are marked
+        {"daft punk 1999-2001", "daft punk 1999-2001", DownloadOptions{}},
+        {"opus magnum wav", "opus magnum wav", DownloadOptions{}},
+        {"daft punk -f mp3", "daft punk", DownloadOptions{format: "mp3"}},
+        {"--format=FLAC daft punk", "daft punk", DownloadOptions{format: "flac"}},
+        {"https://youtu.be/abc -r 1:23-2:05 --fade", "https://youtu.be/abc", DownloadOptions{start: 83 * time.Second, end: 125 * time.Second, fade_in: default_fade, fade_out: default_fade}},
+        {"song --range=0:30- --fadeout=3.5 -f opus", "song", DownloadOptions{format: "opus", start: 30 * time.Second, fade_out: 3500 * time.Millisecond}},
+        {"song --fadein", "song", DownloadOptions{fade_in: default_fade}},
+        // After a link a bare format or range is still understood
+        {"https://youtu.be/x 1:23-2:05", "https://youtu.be/x", DownloadOptions{start: 83 * time.Second, end: 125 * time.Second}},
+        {"https://youtu.be/x mp3", "https://youtu.be/x", DownloadOptions{format: "mp3"}},
+        {"https://youtu.be/x 0:10-0:20 OPUS", "https://youtu.be/x", DownloadOptions{format: "opus", start: 10 * time.Second, end: 20 * time.Second}},
+        {"https://youtu.be/x --fade 0:30-", "https://youtu.be/x", DownloadOptions{start: 30 * time.Second, fade_in: default_fade, fade_out: default_fade}},
+        // A lone dash is part of the search
+        {"artist - title -live", "artist - title -live", DownloadOptions{}},
+    }
+    for _, v := range valid {
+        query, opts, err := parse_download_args(v.argument)
+        if err != nil || query != v.query || opts != v.opts {
+            t.Errorf("%q gave %q, %+v, %v, expected %q, %+v", v.argument, query, opts, err, v.query, v.opts)
+        }
+    }
+
+    invalid := []string{
+        "song -f ogg",
+        "song -f",
+        "song --range 2:00-1:00",
+        "song --range=soon",
+        "song --fade=0",
+        "song --fade=90",
+        "song --fade=nan",
+        "song --bitrate=320",
+        // Words after a link would be ignored, so they have to be options
+        "https://youtu.be/x live version",
+        "https://youtu.be/x 2:05-1:23",
+        "https://youtu.be/x ogg",
+    }
+    for _, argument := range invalid {
+        if query, opts, err := parse_download_args(argument); err == nil {
+            t.Errorf("%q gave %q, %+v, expected an error", argument, query, opts)
+        }
+    }
+}
+
+
+func TestDownloadBitrate(t *testing.T) {
+    limit := int64(10 * 1024 * 1024)
+
+    // Short enough for the default bitrate
+    bitrate, err := download_bitrate(download_formats["mp3"], 3*time.Minute, limit)
+    if err != nil || bitrate != 192 {
+        t.Fatalf("short mp3 gave %d, %v", bitrate, err)
+    }
+
+    // Long tracks are encoded at whatever fits, until that is too low to be worth it
+    bitrate, err = download_bitrate(download_formats["mp3"], 20*time.Minute, limit)
+    if err != nil || bitrate >= 192 || bitrate < 64 {
+        t.Fatalf("long mp3 gave %d, %v", bitrate, err)
+    }
+    if _, err = download_bitrate(download_formats["mp3"], 3*time.Hour, limit); err == nil {
+        t.Fatalf("a 3 hour mp3 fit")
+    }
+
+    // Lossless formats are turned down when they clearly can not fit, before anything is converted
+    for _, name := range []string{"flac", "wav"} {
+        if _, err = download_bitrate(download_formats[name], 30*time.Second, limit); err != nil {
+            t.Errorf("30 seconds of %s did not fit: %v", name, err)
+        }
+        if _, err = download_bitrate(download_formats[name], 10*time.Minute, limit); err == nil {
+            t.Errorf("10 minutes of %s fit", name)
+        }
+    }
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// An effect applied to a guild's audio by ffmpeg, with the value it was given
+type AudioFilter struct {
+    name string
+    value float64
+}
+
+// Something +filter can apply, and how to turn it into part of an ffmpeg filter graph
+type filter_def struct {
+    help string
+    // What the value means, shown in +filter list
+    unit string
+    def float64
+    min float64
+    max float64
+    graph func(value float64) string
+    // How much faster than normal the filter plays the track, nil if it does not change the speed
+    tempo func(value float64) float64
+}
+
+var (
+    audio_filters = map[string]filter_def{
+        "bassboost": {
+            help: "Boosts the low end",
+            unit: "dB",
+            def: 10, min: 1, max: 20,
+            graph: func(v float64) string {
+                return fmt.Sprintf("bass=g=%g:f=110:w=0.6", v)
+            },
+        },
+        "nightcore": {
+            help: "Speeds the track up and raises the pitch with it",
+            unit: "x speed",
+            def: 1.25, min: 1.05, max: 2,
+            graph: func(v float64) string {
+                return resample_graph(v)
+            },
+            tempo: func(v float64) float64 {
+                return v
+            },
+        },
+        "speed": {
+            help: "Changes the speed without changing the pitch",
+            unit: "x speed",
+            def: 1.25, min: 0.5, max: 2,
+            graph: func(v float64) string {
+                return fmt.Sprintf("atempo=%g", v)
+            },
+            tempo: func(v float64) float64 {
+                return v
+            },
+        },
+        "pitch": {
+            help: "Changes the pitch without changing the speed",
+            unit: "semitones",
+            def: 2, min: -12, max: 12,
+            // Resampling shifts both pitch and speed, atempo then puts the speed back
+            graph: func(v float64) string {
+                rate := math.Pow(2, v/12)
+                return fmt.Sprintf("%s,atempo=%g", resample_graph(rate), 1/rate)
+            },
+        },
+        "8d": {
+            help: "Pans the audio around your head",
+            unit: "seconds per rotation",
+            def: 8, min: 1, max: 30,
+            graph: func(v float64) string {
+                return fmt.Sprintf("apulsator=hz=%g:amount=0.8", 1/v)
+            },
+        },
+        "karaoke": {
+            help: "Removes vocals mixed into the centre",
+            unit: "strength from 0 to 1",
+            def: 1, min: 0.1, max: 1,
+            // Subtracting each channel from the other cancels out whatever is the same in both
+            graph: func(v float64) string {
+                return fmt.Sprintf("aformat=channel_layouts=stereo,pan=stereo|c0=c0-%g*c1|c1=c1-%g*c0", v, v)
+            },
+        },
+    }
+)
+
+
+func filter_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
+    fields := strings.Fields(strings.ToLower(cmd_argument(m.Content)))
+
+    if len(fields) == 0 || fields[0] == "list" {
+        s.ChannelMessageSend(m.ChannelID, filter_list(get_guild_settings(m.GuildID).filters))
+        return
+    }
+
+    syntax := fmt.Sprintf("Invalid syntax: use `%cfilter [name] [value]`, `%cfilter [name] off`, `%cfilter clear` or `%cfilter list`",
+        settings.cmd_prefix, settings.cmd_prefix, settings.cmd_prefix, settings.cmd_prefix)
+
+    var filters []AudioFilter
+    var msg string
+    switch {
+    case fields[0] == "clear" && len(fields) == 1:
+        msg = "Cleared all filters"
+
+    case len(fields) <= 2:
+        name := fields[0]
+        def, exists := audio_filters[name]
+        if !exists {
+            s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unknown filter '%s', use `%cfilter list` to see them all", name, settings.cmd_prefix))
+            return
+        }
+
+        // Keep the other filters in the order they were added, replacing this one if it is already on
+        current := get_guild_settings(m.GuildID).filters
+        for _, f := range current {
+            if f.name != name {
+                filters = append(filters, f)
+            }
+        }
+
+        if len(fields) == 2 && fields[1] == "off" {
+            msg = fmt.Sprintf("Turned off %s", name)
+            break
+        }
+
+        value := def.def
+        if len(fields) == 2 {
+            var err error
+            value, err = strconv.ParseFloat(fields[1], 64)
+            // NaN passes both comparisons, so it has to be turned down on its own
+            if err != nil || math.IsNaN(value) || value < def.min || value > def.max {
+                s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("The value for %s has to be %g to %g (%s)", name, def.min, def.max, def.unit))
+                return
+            }
+        }
+        filters = append(filters, AudioFilter{name: name, value: value})
+        msg = fmt.Sprintf("Filters: %s", filter_summary(filters))
+
+    default:
+        s.ChannelMessageSend(m.ChannelID, syntax)
+        return
+    }
+
+    update_guild_settings(m.GuildID, func(gs *GuildSettings) {
+        gs.filters = filters
+    })
+    s.ChannelMessageSend(m.ChannelID, msg)
+
+    // Start decoding the current track again from where it is, so the change is heard straight away
+    if p := get_player(m.GuildID); p != nil {
+        p.restart("filters changed")
+    }
+}
+
+
+func filter_list(active []AudioFilter) string {
+    names := make([]string, 0, len(audio_filters))
+    for name := range audio_filters {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    list := "Filters:"
+    for _, name := range names {
+        def := audio_filters[name]
+        list += fmt.Sprintf("\n`%s [%g to %g]` -> %s, value is %s (default %g)", name, def.min, def.max, def.help, def.unit, def.def)
+    }
+    if len(active) > 0 {
+        list += fmt.Sprintf("\nActive: %s", filter_summary(active))
+    }
+    return list
+}
+
+
+// Lists active filters for messages, e.g. "bassboost 10, speed 1.25"
+func filter_summary(filters []AudioFilter) string {
+    parts := make([]string, 0, len(filters))
+    for _, f := range filters {
+        parts = append(parts, fmt.Sprintf("%s %g", f.name, f.value))
+    }
+    return strings.Join(parts, ", ")
+}
+
+
+// Builds the ffmpeg filter graph for a set of filters, applied in the order they were added
+func filter_graph(filters []AudioFilter) string {
+    parts := make([]string, 0, len(filters))
+    for _, f := range filters {
+        parts = append(parts, audio_filters[f.name].graph(f.value))
+    }
+    return strings.Join(parts, ",")
+}
+
+
+// Builds the whole filter graph for a guild, normalization goes last so it evens out whatever the filters did
+func audio_graph(gs GuildSettings) string {
+    graph := filter_graph(gs.filters)
+    if gs.normalize {
+        if graph != "" {
+            graph += ","
+        }
+        graph += loudnorm_graph(gs.target_lufs)
+    }
+    return graph
+}
+
+
+// Describes everything being done to a guild's audio for messages, empty if nothing is
+func effects_summary(gs GuildSettings) string {
+    summary := filter_summary(gs.filters)
+    if gs.normalize {
+        if summary != "" {
+            summary += ", "
+        }
+        summary += fmt.Sprintf("normalized to %g LUFS", gs.target_lufs)
+    }
+    return summary
+}
+
+
+// How much faster than normal a set of filters plays a track, used to work out the position in the track
+func filter_tempo(filters []AudioFilter) float64 {
+    tempo := 1.0
+    for _, f := range filters {
+        if t := audio_filters[f.name].tempo; t != nil {
+            tempo *= t(f.value)
+        }
+    }
+    return tempo
+}
+
+
+// Changes the sample rate label without resampling, which shifts pitch and speed together, then resamples back to 48 kHz
+func resample_graph(rate float64) string {
+    return fmt.Sprintf("aresample=%d,asetrate=%d,aresample=%d", audio_sample_rate, int(float64(audio_sample_rate)*rate), audio_sample_rate)
+}
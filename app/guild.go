@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Preferences set by the users of a guild
+// These are kept for as long as the bot runs, separately from calls, so they survive leaving and rejoining voice
+type GuildSettings struct {
+    // Percentage, 100 leaves the audio untouched
+    volume int
+    // ffmpeg effects, in the order they were turned on
+    filters []AudioFilter
+    // EBU R128 loudness normalization, and the integrated loudness it aims for
+    normalize bool
+    target_lufs float64
+    // Length of the crossfade between tracks, 0 for none
+    crossfade time.Duration
+    // Keeps the encoder going between tracks so there is no silence in between
+    gapless bool
+}
+
+var (
+    guild_settings = map[string]GuildSettings{}
+    guild_settings_mutx sync.Mutex
+)
+
+
+func default_guild_settings() GuildSettings {
+    return GuildSettings{
+        volume: 100,
+        target_lufs: default_target_lufs,
+    }
+}
+
+
+func get_guild_settings(guild_id string) GuildSettings {
+    guild_settings_mutx.Lock()
+    defer guild_settings_mutx.Unlock()
+
+    gs, exists := guild_settings[guild_id]
+    if !exists {
+        return default_guild_settings()
+    }
+    return gs
+}
+
+
+// Changes the settings of a guild, returning the new settings
+func update_guild_settings(guild_id string, update func(*GuildSettings)) GuildSettings {
+    guild_settings_mutx.Lock()
+    defer guild_settings_mutx.Unlock()
+
+    gs, exists := guild_settings[guild_id]
+    if !exists {
+        gs = default_guild_settings()
+    }
+    update(&gs)
+    guild_settings[guild_id] = gs
+    return gs
+}
+
+
+// Opus packets can only be sent as they are when nothing about the audio needs changing
+func can_passthrough(guild_id string) bool {
+    gs := get_guild_settings(guild_id)
+    return !changes_sound(gs) && gs.crossfade == 0
+}
+
+
+// Whether the settings change how a track sounds while it plays, crossfades only change the end of it
+func changes_sound(gs GuildSettings) bool {
+    return gs.volume != 100 || len(gs.filters) > 0 || gs.normalize
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Asks the run goroutine to leave the call when it fires, unless it has been stopped or replaced first
+type player_timeout struct {
+    timer *time.Timer
+    // Why the bot left, shown to users
+    reason string
+}
+
+// Sent whenever someone joins or leaves the bot's voice channel
+type player_alone struct {
+    alone bool
+}
+
+
+func voice_state_update(s *discordgo.Session, v *discordgo.VoiceStateUpdate) {
+    p := get_player(v.GuildID)
+    if p == nil {
+        return
+    }
+
+    // The bot itself was moved or disconnected, e.g. by an admin
+    if v.UserID == s.State.User.ID {
+        if v.ChannelID == "" {
+            // Also seen when the bot leaves by itself, in which case the player is already on its way out
+            log.Printf("disconnected from voice in %s\n", v.GuildID)
+            p.leave()
+            return
+        }
+        p.send(player_moved{channel_id: v.ChannelID})
+    }
+
+    // Only the channel the bot is in matters, the state has already been updated with this change
+    bot_state, err := s.State.VoiceState(v.GuildID, s.State.User.ID)
+    if err != nil || bot_state.ChannelID == "" {
+        return
+    }
+    p.send(player_alone{alone: count_listeners(s, v.GuildID, bot_state.ChannelID) == 0})
+}
+
+
+// Number of people in a voice channel, not counting bots
+func count_listeners(s *discordgo.Session, guild_id string, channel_id string) int {
+    g, err := s.State.Guild(guild_id)
+    if err != nil {
+        return 0
+    }
+
+    // Copy the IDs out first, as looking up members takes the state lock again
+    var users []string
+    s.State.RLock()
+    for _, vs := range g.VoiceStates {
+        if vs.ChannelID == channel_id && vs.UserID != s.State.User.ID {
+            users = append(users, vs.UserID)
+        }
+    }
+    s.State.RUnlock()
+
+    listeners := 0
+    for _, user_id := range users {
+        member, err := s.State.Member(guild_id, user_id)
+        if err == nil && member.User != nil && member.User.Bot {
+            continue
+        }
+        listeners++
+    }
+    return listeners
+}
+
+
+// Starts a timeout that leaves the call after the given time
+func (p *Player) start_timeout(after time.Duration, reason string) *player_timeout {
+    t := &player_timeout{reason: reason}
+    t.timer = time.AfterFunc(after, func() {
+        p.send(t)
+    })
+    return t
+}
+
+
+func (t *player_timeout) stop() {
+    if t != nil {
+        t.timer.Stop()
+    }
+}
+
+
+// Starts or stops the idle timeout, which runs whenever nothing is playing
+func (p *Player) update_idle_timeout() {
+    idle := p.current == nil && !p.leaving && settings.idle_timeout > 0
+    if idle && p.idle_timeout == nil {
+        p.idle_timeout = p.start_timeout(settings.idle_timeout, fmt.Sprintf("nothing has played for %s", settings.idle_timeout))
+    } else if !idle && p.idle_timeout != nil {
+        p.idle_timeout.stop()
+        p.idle_timeout = nil
+    }
+}
+
+
+func (t *player_timeout) apply(p *Player) {
+    // A timer can fire just as it is being stopped, only the current ones count
+    if t != p.idle_timeout && t != p.alone_timeout {
+        return
+    }
+
+    log.Printf("leaving %s: %s\n", p.guild_id, t.reason)
+    if p.txt_chan != "" {
+        p.message(p.txt_chan, fmt.Sprintf("Left the call, %s", t.reason))
+    }
+    player_leave{}.apply(p)
+}
+
+
+func (c player_alone) apply(p *Player) {
+    if settings.alone_timeout == 0 || c.alone == (p.alone_timeout != nil) {
+        return
+    }
+
+    if !c.alone {
+        // Someone came back before the bot gave up, so carry on from where it was
+        p.alone_timeout.stop()
+        p.alone_timeout = nil
+        if p.alone_paused {
+            p.alone_paused = false
+            if p.pause.set(false) && p.txt_chan != "" {
+                p.message(p.txt_chan, "Someone is back, resuming")
+            }
+        }
+        return
+    }
+
+    // Nobody is listening, so pause until someone comes back or it is time to leave
+    msg := fmt.Sprintf("Everyone left, leaving in %s unless someone comes back", settings.alone_timeout)
+    if p.current != nil && p.pause.set(true) {
+        p.alone_paused = true
+        msg = fmt.Sprintf("Everyone left, pausing and leaving in %s unless someone comes back", settings.alone_timeout)
+    }
+    if p.txt_chan != "" {
+        p.message(p.txt_chan, msg)
+    }
+    p.alone_timeout = p.start_timeout(settings.alone_timeout, fmt.Sprintf("nobody else was in it for %s", settings.alone_timeout))
+}
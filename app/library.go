@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A single audio file within the music library
+type LibraryEntry struct {
+    // Path relative to the library directory, used as the stable ID of the entry
+    rel_path string
+    title string
+    artist string
+    album string
+    duration time.Duration
+    mod_time time.Time
+}
+
+type local_source struct {
+    path string
+}
+
+var (
+    library = map[string]LibraryEntry{}
+    library_mutx sync.RWMutex
+    // Only one scan should run at a time
+    library_scan_mutx sync.Mutex
+
+    library_extensions = map[string]bool{
+        ".mp3": true,
+        ".flac": true,
+        ".ogg": true,
+        ".opus": true,
+    }
+
+    // Reads a file's tags and duration, tests swap this out so they do not need ffprobe
+    probe_library_file = probe_media
+)
+
+const (
+    library_prefix string = "lib:"
+    library_result_count int = 10
+    library_probe_timeout time.Duration = 10 * time.Second
+)
+
+
+func (l *local_source) open() (io.ReadCloser, error) {
+    return os.Open(l.path)
+}
+
+
+func track_from_library(entry LibraryEntry, requester string) *Track {
+    return &Track{
+        id: library_prefix + entry.rel_path,
+        title: entry.display_name(),
+        duration: entry.duration,
+        requester: requester,
+        source: &local_source{path: filepath.Join(settings.library_dir, entry.rel_path)},
+    }
+}
+
+
+func (e LibraryEntry) display_name() string {
+    if e.artist != "" {
+        return fmt.Sprintf("%s - %s", e.artist, e.title)
+    }
+    return e.title
+}
+
+
+// Walks the library directory and (re)builds the index
+// Files that have not changed since the last scan are not probed again
+func scan_library() error {
+    library_scan_mutx.Lock()
+    defer library_scan_mutx.Unlock()
+
+    start := time.Now()
+    new_library := map[string]LibraryEntry{}
+
+    err := filepath.WalkDir(settings.library_dir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            log.Printf("library: skipping %s: %s\n", path, err.Error())
+            return nil
+        }
+        if d.IsDir() || !library_extensions[strings.ToLower(filepath.Ext(path))] {
+            return nil
+        }
+
+        rel_path, err := filepath.Rel(settings.library_dir, path)
+        if err != nil {
+            return nil
+        }
+        info, err := d.Info()
+        if err != nil {
+            return nil
+        }
+
+        // Reuse the existing entry if the file has not been modified
+        library_mutx.RLock()
+        old, exists := library[rel_path]
+        library_mutx.RUnlock()
+        if exists && old.mod_time.Equal(info.ModTime()) {
+            new_library[rel_path] = old
+            return nil
+        }
+
+        entry, err := index_file(path, rel_path)
+        if err != nil {
+            log.Printf("library: unable to index %s: %s\n", rel_path, err.Error())
+            return nil
+        }
+        entry.mod_time = info.ModTime()
+        new_library[rel_path] = entry
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    library_mutx.Lock()
+    library = new_library
+    library_mutx.Unlock()
+
+    log.Printf("library: indexed %d files in %v\n", len(new_library), time.Since(start))
+    return nil
+}
+
+
+// Reads the tags and duration of a single file
+func index_file(path string, rel_path string) (LibraryEntry, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), library_probe_timeout)
+    defer cancel()
+
+    probe, err := probe_library_file(path, ctx)
+    if err != nil {
+        return LibraryEntry{}, err
+    }
+
+    entry := LibraryEntry{
+        rel_path: rel_path,
+        title: probe.tags["title"],
+        artist: probe.tags["artist"],
+        album: probe.tags["album"],
+        duration: probe.duration,
+    }
+
+    // Untagged files fall back to their file name
+    if entry.title == "" {
+        entry.title = strings.TrimSuffix(filepath.Base(rel_path), filepath.Ext(rel_path))
+    }
+
+    return entry, nil
+}
+
+
+// Finds library entries where every word of the query appears in the title, artist, album or path
+// The best matches come first: an exact title, then a title or artist starting with the query, then the query appearing in the path
+func search_library(query string, limit int) []LibraryEntry {
+    query = strings.ToLower(strings.TrimSpace(query))
+    words := strings.Fields(query)
+
+    library_mutx.RLock()
+    results := []LibraryEntry{}
+    ranks := map[string]int{}
+    for _, entry := range library {
+        haystack := strings.ToLower(strings.Join([]string{entry.title, entry.artist, entry.album, entry.rel_path}, " "))
+        matched := true
+        for _, w := range words {
+            if !strings.Contains(haystack, w) {
+                matched = false
+                break
+            }
+        }
+        if matched {
+            results = append(results, entry)
+            ranks[entry.rel_path] = library_rank(entry, query)
+        }
+    }
+    library_mutx.RUnlock()
+
+    // Map iteration order is random, so equally good matches are sorted by path to keep results stable between searches
+    sort.Slice(results, func(i, j int) bool {
+        ri, rj := ranks[results[i].rel_path], ranks[results[j].rel_path]
+        if ri != rj {
+            return ri < rj
+        }
+        return results[i].rel_path < results[j].rel_path
+    })
+
+    if len(results) > limit {
+        results = results[:limit]
+    }
+    return results
+}
+
+
+// How well an entry matches a lower case query, lower is better
+func library_rank(entry LibraryEntry, query string) int {
+    title := strings.ToLower(entry.title)
+    switch {
+    case title == query:
+        return 0
+    case strings.HasPrefix(title, query) || strings.HasPrefix(strings.ToLower(entry.artist), query):
+        return 1
+    case strings.Contains(strings.ToLower(entry.rel_path), query):
+        return 2
+    }
+    return 3
+}
+
+
+func library_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
+    if settings.library_dir == "" {
+        s.ChannelMessageSend(m.ChannelID, "No music library has been configured")
+        return
+    }
+
+    sub_sections := strings.SplitN(cmd_argument(m.Content), " ", 2)
+    switch sub_sections[0] {
+    case "search":
+        if len(sub_sections) < 2 || strings.TrimSpace(sub_sections[1]) == "" {
+            s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid syntax: use `%clibrary search [text]`", settings.cmd_prefix))
+            return
+        }
+
+        results := search_library(sub_sections[1], library_result_count)
+        if len(results) == 0 {
+            s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Nothing in the library matches '%s'", sub_sections[1]))
+            return
+        }
+
+        list := fmt.Sprintf("Library results for '%s':", sub_sections[1])
+        for _, entry := range results {
+            list += fmt.Sprintf("\n%s", entry.display_name())
+            if entry.album != "" {
+                list += fmt.Sprintf(" (%s)", entry.album)
+            }
+            list += fmt.Sprintf(" [%v]", entry.duration)
+        }
+        list += fmt.Sprintf("\nUse `%cplay %s[text]` to play one", settings.cmd_prefix, library_prefix)
+        s.ChannelMessageSend(m.ChannelID, list)
+
+    case "rescan":
+        s.ChannelMessageSend(m.ChannelID, "Rescanning the music library")
+        err := scan_library()
+        if err != nil {
+            s.ChannelMessageSend(m.ChannelID, "Unable to scan the music library")
+            log.Printf("library: scan failed: %s\n", err.Error())
+            return
+        }
+        library_mutx.RLock()
+        count := len(library)
+        library_mutx.RUnlock()
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Library now has %d files", count))
+
+    default:
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid syntax: use `%clibrary search [text]` or `%clibrary rescan`", settings.cmd_prefix, settings.cmd_prefix))
+    }
+}
+
+
+// Handles `play lib:[query]`, queueing the best match from the library
+func play_library(s *discordgo.Session, m *discordgo.MessageCreate, query string) {
+    if settings.library_dir == "" {
+        s.ChannelMessageSend(m.ChannelID, "No music library has been configured")
+        return
+    }
+
+    results := search_library(query, 1)
+    if len(results) == 0 {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Nothing in the library matches '%s'", query))
+        return
+    }
+    log.Printf("found library file: [%s]\n", results[0].rel_path)
+
+    enqueue_track(s, m, track_from_library(results[0], m.Author.Username))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Replaces the library index for one test
+func use_library(t *testing.T, entries ...LibraryEntry) {
+    library_mutx.Lock()
+    old := library
+    library = map[string]LibraryEntry{}
+    for _, e := range entries {
+        library[e.rel_path] = e
+    }
+    library_mutx.Unlock()
+
+    t.Cleanup(func() {
+        library_mutx.Lock()
+        library = old
+        library_mutx.Unlock()
+    })
+}
+
+
+func TestSearchLibraryRanking(t *testing.T) {
+    use_library(t,
+        LibraryEntry{rel_path: "z.mp3", title: "World Around The"},
+        LibraryEntry{rel_path: "around the world/live.mp3", title: "Live", artist: "Other"},
+        LibraryEntry{rel_path: "x.mp3", title: "Something", artist: "Around the World Band"},
+        LibraryEntry{rel_path: "around the world (remix).mp3", title: "Around the World (Remix)"},
+        LibraryEntry{rel_path: "one/track.mp3", title: "Around the World", artist: "Daft Punk"},
+        LibraryEntry{rel_path: "unrelated.mp3", title: "Harder Better"},
+    )
+
+    expected := []string{
+        // Exact title
+        "one/track.mp3",
+        // Title or artist starting with the query, by path
+        "around the world (remix).mp3",
+        "x.mp3",
+        // Query in the path
+        "around the world/live.mp3",
+        // Only the separate words match
+        "z.mp3",
+    }
+    results := search_library("  Around the WORLD ", 10)
+    if len(results) != len(expected) {
+        t.Fatalf("got %d results, expected %d", len(results), len(expected))
+    }
+    for i := range expected {
+        if results[i].rel_path != expected[i] {
+            t.Fatalf("result %d was %s, expected %s", i, results[i].rel_path, expected[i])
+        }
+    }
+
+    // play lib: takes the single best match
+    results = search_library("around the world", 1)
+    if len(results) != 1 || results[0].rel_path != "one/track.mp3" {
+        t.Fatalf("best match was %v", results)
+    }
+}
+
+
+func TestScanLibraryReusesUnchanged(t *testing.T) {
+    dir := t.TempDir()
+    set_test_settings(t, func(s *Settings) {
+        s.library_dir = dir
+    })
+    use_library(t)
+
+    var probed []string
+    old_probe := probe_library_file
+    probe_library_file = func(input string, ctx context.Context) (ProbeResult, error) {
+        probed = append(probed, filepath.Base(input))
+        return ProbeResult{tags: map[string]string{"title": filepath.Base(input)}}, nil
+    }
+    t.Cleanup(func() {
+        probe_library_file = old_probe
+    })
+
+    for _, name := range []string{"a.mp3", "b.flac", "notes.txt"} {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    scan := func() {
+        t.Helper()
+        probed = nil
+        if err := scan_library(); err != nil {
+            t.Fatalf("scan: %v", err)
+        }
+    }
+
+    // Every audio file is probed the first time
+    scan()
+    if len(probed) != 2 {
+        t.Fatalf("probed %v, expected both audio files", probed)
+    }
+
+    // Nothing changed, so nothing is probed again
+    scan()
+    if len(probed) != 0 {
+        t.Fatalf("probed %v, expected nothing", probed)
+    }
+
+    // Only the modified file is probed, and removed files leave the index
+    later := time.Now().Add(time.Hour)
+    if err := os.Chtimes(filepath.Join(dir, "a.mp3"), later, later); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Remove(filepath.Join(dir, "b.flac")); err != nil {
+        t.Fatal(err)
+    }
+    scan()
+    if len(probed) != 1 || probed[0] != "a.mp3" {
+        t.Fatalf("probed %v, expected only a.mp3", probed)
+    }
+
+    library_mutx.RLock()
+    defer library_mutx.RUnlock()
+    if len(library) != 1 || !library["a.mp3"].mod_time.Equal(later) {
+        t.Fatalf("library is %v", library)
+    }
+}
@@ -5,8 +5,10 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -14,6 +16,21 @@ import (
 type Settings struct {
     token_secret_path string
     cmd_prefix byte
+    playlist_limit int
+    library_dir string
+    attachment_max_bytes int
+    // Youtube audio codecs in order of preference, e.g. ["opus", "aac"]
+    audio_codecs []string
+    // Highest youtube audio bitrate to prefer in bits per second, 0 for no limit
+    audio_max_bitrate int
+    // Directory for cached Opus tracks, caching is disabled if this is empty
+    cache_dir string
+    cache_max_bytes int64
+    // How long a call can stay paused before the bot leaves, 0 to stay forever
+    pause_timeout time.Duration
+    // How long the bot stays once everyone else has left its channel, and once nothing is playing, 0 to stay forever
+    alone_timeout time.Duration
+    idle_timeout time.Duration
 }
 
 type Command struct {
@@ -33,7 +50,7 @@ func build_commands() {
             act: show_help,
         },
         "dl": {
-            help: "Pipes audio file from youtube to discord as file upload",
+            help: "Uploads the audio of a youtube video (link or search) to discord, optionally clipped to a time range or converted to mp3, opus, flac or wav",
             act: download_cmd,
         },
         "join":{
@@ -45,7 +62,7 @@ func build_commands() {
                     log.Printf("could not find vc: %s\n", err.Error())
                     return
                 }
-                err = join_voice(s, m.GuildID, vc_id)
+                _, err = join_voice(s, m.GuildID, vc_id, m.ChannelID)
                 if err != nil {
                     s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unable to join voice channel: %s", err.Error()))
                     log.Printf("joining vc: %s", err.Error())
@@ -59,10 +76,46 @@ func build_commands() {
                 leave_voice(m.GuildID)
             },
         },
+        "move": {
+            help: "Moves the bot to your voice channel, or another one with `move [channel]`, keeping the queue playing",
+            act: move_cmd,
+        },
         "play": {
-            help: "Plays the specified youtube link",
+            help: "Plays the specified youtube link, the top result of a search, a library file with `lib:[text]`, or attached audio files",
             act: play_cmd,
         },
+        "search": {
+            help: "Lists the top youtube results for a search, reply with a number to play one",
+            act: search_cmd,
+        },
+        "library": {
+            help: "Search (`library search [text]`) or rescan (`library rescan`) the local music library",
+            act: library_cmd,
+        },
+        "seek": {
+            help: "Jump to a time in the current song, e.g. `seek 2:30`, `seek +30s` or `seek -10s`",
+            act: seek_cmd,
+        },
+        "volume": {
+            help: "Show or set the volume for this server, from 0 to 200 (default 100)",
+            act: volume_cmd,
+        },
+        "filter": {
+            help: "Applies an audio effect (`filter [name] [value]`), turns one off (`filter [name] off`), or `filter clear` / `filter list`",
+            act: filter_cmd,
+        },
+        "normalize": {
+            help: "Evens out the loudness of tracks (`normalize on|off`), optionally to a target LUFS (`normalize -16`)",
+            act: normalize_cmd,
+        },
+        "crossfade": {
+            help: "Fades each track into the next over a number of seconds (`crossfade 5`), or `crossfade off`",
+            act: crossfade_cmd,
+        },
+        "gapless": {
+            help: "Plays tracks straight into each other without any silence between them (`gapless on|off`)",
+            act: gapless_cmd,
+        },
         "q": {
             help: "Display the current queue",
             act: queue_cmd,
@@ -98,6 +151,24 @@ func main() {
     // Build the commands hashmap
     build_commands()
 
+    // Load the index of cached tracks
+    if settings.cache_dir != "" {
+        err = init_cache()
+        if err != nil {
+            log.Fatalf("error loading cache: %s\n", err.Error())
+        }
+    }
+
+    // Index the local music library in the background, it can take a while for large libraries
+    if settings.library_dir != "" {
+        go func() {
+            err := scan_library()
+            if err != nil {
+                log.Printf("library: scan failed: %s\n", err.Error())
+            }
+        }()
+    }
+
     // Read secret file
     tok_file_contents, err := os.ReadFile(settings.token_secret_path)
     if err != nil {
@@ -112,6 +183,7 @@ func main() {
 
     // Configure event handlers for bot
     bot.AddHandler(message_create)
+    bot.AddHandler(voice_state_update)
 
     // Set intents of bot
     bot.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsGuilds | discordgo.IntentsGuildVoiceStates
@@ -148,6 +220,11 @@ func message_create(s *discordgo.Session, m *discordgo.MessageCreate) {
          return
     }
 
+    // If the author has a search waiting on them, this message may be their pick
+    if handle_search_pick(s, m) {
+        return
+    }
+
     // make sure the message starts with the bot's cmd prefix
     if m.Content[0] != settings.cmd_prefix {
         return
@@ -165,8 +242,19 @@ func message_create(s *discordgo.Session, m *discordgo.MessageCreate) {
 }
 
 
+// Returns everything in a message after the command itself, e.g. "+play a b c" -> "a b c"
+func cmd_argument(content string) string {
+    cmd_sections := strings.SplitN(content[1:], " ", 2)
+    if len(cmd_sections) < 2 {
+        return ""
+    }
+    return strings.TrimSpace(cmd_sections[1])
+}
+
+
 func load_settings() (Settings, error) {
     var s Settings 
+    var err error
 
     // Read CMD Prefix setting
     prefix_s, set := os.LookupEnv("PREFIX")
@@ -186,5 +274,120 @@ func load_settings() (Settings, error) {
     }
     s.token_secret_path = tok_path
 
+    // Read the max number of entries queued from a single playlist
+    limit_s, set := os.LookupEnv("PLAYLIST_LIMIT")
+    if !set {
+        s.playlist_limit = 100
+    } else {
+        s.playlist_limit, err = strconv.Atoi(limit_s)
+        if err != nil || s.playlist_limit < 1 {
+            return s, fmt.Errorf("invalid playlist limit: must be a positive number")
+        }
+    }
+    log.Printf("Playlist limit set to: %d\n", s.playlist_limit)
+
+    // Read the local music library directory, the library is disabled if this is not set
+    s.library_dir = os.Getenv("LIBRARY_DIR")
+    if s.library_dir != "" {
+        info, err := os.Stat(s.library_dir)
+        if err != nil || !info.IsDir() {
+            return s, fmt.Errorf("invalid library dir: '%s' is not a directory", s.library_dir)
+        }
+        log.Printf("Library dir set to: '%s'\n", s.library_dir)
+    }
+
+    // Read the max size of audio files that can be played from attachments
+    attach_s, set := os.LookupEnv("ATTACHMENT_MAX_MB")
+    if !set {
+        s.attachment_max_bytes = 25 * 1024 * 1024
+    } else {
+        mb, err := strconv.Atoi(attach_s)
+        if err != nil || mb < 1 {
+            return s, fmt.Errorf("invalid attachment max size: must be a positive number of MB")
+        }
+        s.attachment_max_bytes = mb * 1024 * 1024
+    }
+    log.Printf("Attachment max size set to: %d MB\n", s.attachment_max_bytes/(1024*1024))
+
+    // Read the preferred youtube audio codecs, opus first as it is what discord uses
+    codecs_s, set := os.LookupEnv("AUDIO_CODECS")
+    if !set {
+        codecs_s = "opus,aac"
+    }
+    for _, codec := range strings.Split(codecs_s, ",") {
+        codec = strings.ToLower(strings.TrimSpace(codec))
+        if codec != "" {
+            s.audio_codecs = append(s.audio_codecs, codec)
+        }
+    }
+    log.Printf("Audio codec preference set to: %v\n", s.audio_codecs)
+
+    // Read the preferred max youtube audio bitrate
+    kbps_s, set := os.LookupEnv("AUDIO_MAX_KBPS")
+    if set {
+        kbps, err := strconv.Atoi(kbps_s)
+        if err != nil || kbps < 0 {
+            return s, fmt.Errorf("invalid audio max kbps: must be 0 (no limit) or a positive number")
+        }
+        s.audio_max_bitrate = kbps * 1000
+    }
+    log.Printf("Audio max bitrate set to: %d kbps\n", s.audio_max_bitrate/1000)
+
+    // Read the opus cache directory and size, the cache is disabled if no directory is set
+    s.cache_dir = os.Getenv("CACHE_DIR")
+    if s.cache_dir != "" {
+        err = os.MkdirAll(s.cache_dir, 0755)
+        if err != nil {
+            return s, fmt.Errorf("invalid cache dir: %s", err.Error())
+        }
+
+        cache_s, set := os.LookupEnv("CACHE_MAX_MB")
+        if !set {
+            s.cache_max_bytes = 1024 * 1024 * 1024
+        } else {
+            mb, err := strconv.Atoi(cache_s)
+            if err != nil || mb < 1 {
+                return s, fmt.Errorf("invalid cache max size: must be a positive number of MB")
+            }
+            s.cache_max_bytes = int64(mb) * 1024 * 1024
+        }
+        log.Printf("Cache set to: '%s' (%d MB)\n", s.cache_dir, s.cache_max_bytes/(1024*1024))
+    }
+
+    // Read how long to wait while paused before leaving the call
+    pause_s, set := os.LookupEnv("PAUSE_TIMEOUT_MIN")
+    if set {
+        mins, err := strconv.Atoi(pause_s)
+        if err != nil || mins < 0 {
+            return s, fmt.Errorf("invalid pause timeout: must be 0 (never leave) or a positive number of minutes")
+        }
+        s.pause_timeout = time.Duration(mins) * time.Minute
+    }
+    log.Printf("Pause timeout set to: %s\n", s.pause_timeout)
+
+    // Read how long to stay in a channel with nobody else in it
+    s.alone_timeout = time.Minute
+    alone_s, set := os.LookupEnv("ALONE_TIMEOUT_SEC")
+    if set {
+        secs, err := strconv.Atoi(alone_s)
+        if err != nil || secs < 0 {
+            return s, fmt.Errorf("invalid alone timeout: must be 0 (never leave) or a positive number of seconds")
+        }
+        s.alone_timeout = time.Duration(secs) * time.Second
+    }
+    log.Printf("Alone timeout set to: %s\n", s.alone_timeout)
+
+    // Read how long to stay in a call with nothing playing
+    s.idle_timeout = 15 * time.Minute
+    idle_s, set := os.LookupEnv("IDLE_TIMEOUT_MIN")
+    if set {
+        mins, err := strconv.Atoi(idle_s)
+        if err != nil || mins < 0 {
+            return s, fmt.Errorf("invalid idle timeout: must be 0 (never leave) or a positive number of minutes")
+        }
+        s.idle_timeout = time.Duration(mins) * time.Minute
+    }
+    log.Printf("Idle timeout set to: %s\n", s.idle_timeout)
+
     return s, nil
 }
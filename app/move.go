@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type player_move struct {
+    channel_id string
+    reply chan error
+}
+
+// Sent when discord says the bot is in a channel, which may not be the one it thought it was in
+type player_moved struct {
+    channel_id string
+}
+
+
+func move_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
+    p := get_player(m.GuildID)
+    if p == nil {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("I'm not in a call, use `%cjoin` or `%cplay` to bring me in", settings.cmd_prefix, settings.cmd_prefix))
+        return
+    }
+
+    // Without an argument, move to whoever sent the command
+    argument := cmd_argument(m.Content)
+    var channel_id string
+    var err error
+    if argument == "" {
+        channel_id, err = vc_from_message(s, m)
+        if err != nil {
+            s.ChannelMessageSend(m.ChannelID, "You are not in a voice channel")
+            log.Printf("could not find vc: %s\n", err.Error())
+            return
+        }
+    } else {
+        channel_id, err = find_voice_channel(s, m.GuildID, argument)
+        if err != nil {
+            s.ChannelMessageSend(m.ChannelID, err.Error())
+            return
+        }
+    }
+
+    // The queue and the current track carry on as they are, packets are held back while the connection moves
+    err = p.move(channel_id)
+    if err != nil {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unable to move: %s", err.Error()))
+        log.Printf("moving vc: %s\n", err.Error())
+        return
+    }
+    s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Moved to <#%s>", channel_id))
+}
+
+
+// Finds a voice channel in a guild from a mention, an ID or its name, ignoring case
+func find_voice_channel(s *discordgo.Session, guild_id string, argument string) (string, error) {
+    g, err := s.State.Guild(guild_id)
+    if err != nil {
+        return "", fmt.Errorf("could not find guild")
+    }
+
+    argument = strings.TrimSuffix(strings.TrimPrefix(argument, "<#"), ">")
+
+    s.State.RLock()
+    defer s.State.RUnlock()
+    for _, c := range g.Channels {
+        if c.Type != discordgo.ChannelTypeGuildVoice && c.Type != discordgo.ChannelTypeGuildStageVoice {
+            continue
+        }
+        if c.ID == argument || strings.EqualFold(c.Name, argument) {
+            return c.ID, nil
+        }
+    }
+    return "", fmt.Errorf("There is no voice channel called '%s'", argument)
+}
+
+
+// Moves the voice connection to another channel in the same guild, keeping the queue and playback as they are
+func (p *Player) move(channel_id string) error {
+    cmd := player_move{channel_id: channel_id, reply: make(chan error, 1)}
+    if !p.send(cmd) {
+        return errors.New("I'm not in a call")
+    }
+    return <-cmd.reply
+}
+
+
+func (c player_move) apply(p *Player) {
+    if p.leaving {
+        c.reply <- errors.New("I'm leaving the call")
+        return
+    }
+    if c.channel_id == p.channel_id {
+        c.reply <- errors.New("I'm already in that channel")
+        return
+    }
+
+    log.Printf("moving to %s\n", c.channel_id)
+    err := p.vc.move(c.channel_id)
+    if err == nil {
+        p.channel_id = c.channel_id
+    }
+    c.reply <- err
+}
+
+
+func (c player_moved) apply(p *Player) {
+    if c.channel_id == p.channel_id {
+        return
+    }
+
+    // Someone dragged the bot, discord reconnects the voice connection by itself and the queued packets carry on from there
+    log.Printf("moved to %s by someone else\n", c.channel_id)
+    p.channel_id = c.channel_id
+    if p.txt_chan != "" {
+        p.message(p.txt_chan, fmt.Sprintf("I was moved to <#%s>", c.channel_id))
+    }
+}
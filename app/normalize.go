@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+    // Roughly what youtube and most streaming services normalize to
+    default_target_lufs float64 = -14
+    min_target_lufs float64 = -40
+    max_target_lufs float64 = -5
+    // Peaks are kept under this, so boosting quiet tracks does not clip
+    loudnorm_true_peak float64 = -1.5
+    loudnorm_range float64 = 11
+)
+
+
+func normalize_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
+    argument := strings.ToLower(cmd_argument(m.Content))
+    gs := get_guild_settings(m.GuildID)
+
+    // Without an argument, just show the current setting
+    if argument == "" {
+        if gs.normalize {
+            s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Loudness normalization is on, targeting %g LUFS", gs.target_lufs))
+        } else {
+            s.ChannelMessageSend(m.ChannelID, "Loudness normalization is off")
+        }
+        return
+    }
+
+    normalize := true
+    target := gs.target_lufs
+    switch argument {
+    case "on":
+    case "off":
+        normalize = false
+    default:
+        var err error
+        target, err = strconv.ParseFloat(strings.TrimSuffix(argument, "lufs"), 64)
+        // NaN passes both comparisons, so it has to be turned down on its own
+        if err != nil || math.IsNaN(target) || target < min_target_lufs || target > max_target_lufs {
+            s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid syntax: use `%cnormalize [on|off]` or `%cnormalize [target LUFS from %g to %g]`",
+                settings.cmd_prefix, settings.cmd_prefix, min_target_lufs, max_target_lufs))
+            return
+        }
+    }
+
+    // Nothing changed, so there is no need to restart the current track
+    if normalize == gs.normalize && (!normalize || target == gs.target_lufs) {
+        s.ChannelMessageSend(m.ChannelID, "Loudness normalization is already set that way")
+        return
+    }
+
+    update_guild_settings(m.GuildID, func(gs *GuildSettings) {
+        gs.normalize = normalize
+        gs.target_lufs = target
+    })
+    if normalize {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Loudness normalization on, targeting %g LUFS", target))
+    } else {
+        s.ChannelMessageSend(m.ChannelID, "Loudness normalization off")
+    }
+
+    // Start decoding the current track again from where it is, so the change is heard straight away
+    if p := get_player(m.GuildID); p != nil {
+        p.restart("normalization changed")
+    }
+}
+
+
+// Single pass EBU R128 normalization, which evens out loudness as the track plays rather than measuring it first
+func loudnorm_graph(target_lufs float64) string {
+    return fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g", target_lufs, loudnorm_true_peak, loudnorm_range)
+}
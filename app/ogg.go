@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Writes Opus packets into an Ogg Opus file (RFC 7845)
+type ogg_opus_writer struct {
+    w io.Writer
+    serial uint32
+    sequence uint32
+    // Total samples written so far, used as the granule position of each page
+    granule uint64
+    // Packets waiting to be written in the next page
+    packets [][]byte
+    segments int
+}
+
+// Reads the Opus packets back out of an Ogg Opus file written by ogg_opus_writer
+// Every page is checked against its CRC, so any corruption is reported as an error rather than played
+type ogg_opus_reader struct {
+    packets [][]byte
+}
+
+const (
+    ogg_flag_continued byte = 0x01
+    ogg_flag_bos byte = 0x02
+    ogg_flag_eos byte = 0x04
+
+    ogg_header_size int = 27
+    ogg_max_segments int = 255
+    // Packets are grouped into pages of about a second
+    ogg_packets_per_page int = 50
+)
+
+var (
+    ogg_crc_table = build_ogg_crc_table()
+)
+
+
+// Ogg uses a CRC-32 with polynomial 0x04C11DB7, no reflection and an initial value of 0
+func build_ogg_crc_table() [256]uint32 {
+    var table [256]uint32
+    for i := range table {
+        r := uint32(i) << 24
+        for j := 0; j < 8; j++ {
+            if r&0x80000000 != 0 {
+                r = r<<1 ^ 0x04C11DB7
+            } else {
+                r <<= 1
+            }
+        }
+        table[i] = r
+    }
+    return table
+}
+
+
+func ogg_crc(data []byte) uint32 {
+    var crc uint32
+    for _, b := range data {
+        crc = crc<<8 ^ ogg_crc_table[byte(crc>>24)^b]
+    }
+    return crc
+}
+
+
+// Number of lacing values a packet takes up, a packet that is a multiple of 255 needs a trailing 0
+func ogg_segment_count(packet []byte) int {
+    return len(packet)/255 + 1
+}
+
+
+func new_ogg_opus_writer(w io.Writer, serial uint32) (*ogg_opus_writer, error) {
+    o := &ogg_opus_writer{w: w, serial: serial}
+
+    // Identification header, always alone in the first page
+    head := make([]byte, 19)
+    copy(head, "OpusHead")
+    head[8] = 1
+    head[9] = byte(audio_chan)
+    binary.LittleEndian.PutUint16(head[10:], 0)
+    binary.LittleEndian.PutUint32(head[12:], uint32(audio_sample_rate))
+    err := o.write_page([][]byte{head}, ogg_flag_bos, 0)
+    if err != nil {
+        return nil, err
+    }
+
+    // Comment header, also alone in its own page
+    vendor := "discord_tunes"
+    tags := make([]byte, 8+4+len(vendor)+4)
+    copy(tags, "OpusTags")
+    binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+    copy(tags[12:], vendor)
+    err = o.write_page([][]byte{tags}, 0, 0)
+    if err != nil {
+        return nil, err
+    }
+
+    return o, nil
+}
+
+
+func (o *ogg_opus_writer) write_packet(packet []byte) error {
+    segments := ogg_segment_count(packet)
+    if segments > ogg_max_segments {
+        return fmt.Errorf("ogg: packet of %d bytes is too big", len(packet))
+    }
+
+    // Start a new page if this packet would not fit
+    if o.segments+segments > ogg_max_segments || len(o.packets) >= ogg_packets_per_page {
+        err := o.flush(0)
+        if err != nil {
+            return err
+        }
+    }
+
+    o.packets = append(o.packets, packet)
+    o.segments += segments
+    o.granule += uint64(audio_frame_size)
+    return nil
+}
+
+
+// Writes out the last page, marking the end of the stream
+func (o *ogg_opus_writer) finish() error {
+    return o.flush(ogg_flag_eos)
+}
+
+
+func (o *ogg_opus_writer) flush(flags byte) error {
+    if len(o.packets) == 0 && flags&ogg_flag_eos == 0 {
+        return nil
+    }
+    err := o.write_page(o.packets, flags, o.granule)
+    o.packets = nil
+    o.segments = 0
+    return err
+}
+
+
+func (o *ogg_opus_writer) write_page(packets [][]byte, flags byte, granule uint64) error {
+    var segment_table []byte
+    var body []byte
+    for _, p := range packets {
+        for i := 0; i < len(p)/255; i++ {
+            segment_table = append(segment_table, 255)
+        }
+        segment_table = append(segment_table, byte(len(p)%255))
+        body = append(body, p...)
+    }
+
+    page := make([]byte, ogg_header_size, ogg_header_size+len(segment_table)+len(body))
+    copy(page, "OggS")
+    page[4] = 0
+    page[5] = flags
+    binary.LittleEndian.PutUint64(page[6:], granule)
+    binary.LittleEndian.PutUint32(page[14:], o.serial)
+    binary.LittleEndian.PutUint32(page[18:], o.sequence)
+    page[26] = byte(len(segment_table))
+    page = append(page, segment_table...)
+    page = append(page, body...)
+
+    // The CRC is calculated over the whole page with the CRC field set to 0
+    binary.LittleEndian.PutUint32(page[22:], ogg_crc(page))
+
+    o.sequence++
+    _, err := o.w.Write(page)
+    return err
+}
+
+
+// Parses and verifies a whole Ogg Opus file
+func read_ogg_opus(data []byte) (*ogg_opus_reader, error) {
+    var packets [][]byte
+    var partial []byte
+    var serial uint32
+    var sequence uint32
+    ended := false
+
+    for len(data) > 0 {
+        if ended {
+            return nil, fmt.Errorf("ogg: data after end of stream")
+        }
+        if len(data) < ogg_header_size || !bytes.Equal(data[:4], []byte("OggS")) {
+            return nil, fmt.Errorf("ogg: missing page header")
+        }
+
+        flags := data[5]
+        page_serial := binary.LittleEndian.Uint32(data[14:])
+        page_sequence := binary.LittleEndian.Uint32(data[18:])
+        crc := binary.LittleEndian.Uint32(data[22:])
+        segment_count := int(data[26])
+
+        header_len := ogg_header_size + segment_count
+        if len(data) < header_len {
+            return nil, fmt.Errorf("ogg: truncated segment table")
+        }
+        body_len := 0
+        for _, lace := range data[ogg_header_size:header_len] {
+            body_len += int(lace)
+        }
+        if len(data) < header_len+body_len {
+            return nil, fmt.Errorf("ogg: truncated page")
+        }
+        page := data[:header_len+body_len]
+        data = data[header_len+body_len:]
+
+        // Check the CRC with the CRC field zeroed, without modifying the original data
+        check := make([]byte, len(page))
+        copy(check, page)
+        binary.LittleEndian.PutUint32(check[22:], 0)
+        if ogg_crc(check) != crc {
+            return nil, fmt.Errorf("ogg: crc mismatch on page %d", page_sequence)
+        }
+
+        // Pages must belong to one stream and come in order, starting with a BOS page
+        if page_sequence == 0 {
+            if flags&ogg_flag_bos == 0 {
+                return nil, fmt.Errorf("ogg: first page is not the start of a stream")
+            }
+            serial = page_serial
+        } else if page_serial != serial || page_sequence != sequence {
+            return nil, fmt.Errorf("ogg: page %d out of order", page_sequence)
+        }
+        sequence = page_sequence + 1
+        ended = flags&ogg_flag_eos != 0
+
+        // Rebuild the packets from their lacing values, a value under 255 ends a packet
+        body := page[header_len:]
+        for _, lace := range page[ogg_header_size:header_len] {
+            partial = append(partial, body[:lace]...)
+            body = body[lace:]
+            if lace < 255 {
+                packets = append(packets, partial)
+                partial = nil
+            }
+        }
+    }
+
+    if !ended {
+        return nil, fmt.Errorf("ogg: stream has no end")
+    }
+    if len(packets) < 2 || !bytes.HasPrefix(packets[0], []byte("OpusHead")) || !bytes.HasPrefix(packets[1], []byte("OpusTags")) {
+        return nil, fmt.Errorf("ogg: missing opus headers")
+    }
+
+    return &ogg_opus_reader{packets: packets[2:]}, nil
+}
+
+
+func (o *ogg_opus_reader) read_packet() ([]byte, error) {
+    if len(o.packets) == 0 {
+        return nil, io.EOF
+    }
+    packet := o.packets[0]
+    o.packets = o.packets[1:]
+    return packet, nil
+}
+
+
+func (o *ogg_opus_reader) Close() error {
+    o.packets = nil
+    return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Whether a call is paused, which the sending threads block on rather than polling
+type pause_state struct {
+    mutx sync.Mutex
+    paused bool
+    // Closed when the call is resumed, and replaced with a new channel each time it is paused
+    resumed chan struct{}
+    // Leaves the call if it stays paused for too long, nil if there is no timeout
+    timer *time.Timer
+}
+
+const (
+    // Discord asks for a few frames of silence when audio stops, so clients do not interpolate the gap
+    silence_frames int = 5
+)
+
+var (
+    opus_silence = []byte{0xF8, 0xFF, 0xFE}
+)
+
+
+func new_pause_state() *pause_state {
+    resumed := make(chan struct{})
+    close(resumed)
+    return &pause_state{resumed: resumed}
+}
+
+
+// Pauses or resumes, returning false if it was already that way
+func (p *pause_state) set(paused bool) bool {
+    p.mutx.Lock()
+    defer p.mutx.Unlock()
+
+    if p.paused == paused {
+        return false
+    }
+    p.paused = paused
+
+    if paused {
+        p.resumed = make(chan struct{})
+    } else {
+        close(p.resumed)
+        if p.timer != nil {
+            p.timer.Stop()
+            p.timer = nil
+        }
+    }
+    return true
+}
+
+
+func (p *pause_state) is_paused() bool {
+    p.mutx.Lock()
+    defer p.mutx.Unlock()
+    return p.paused
+}
+
+
+// Blocks until resumed, returning false if the context was cancelled first
+func (p *pause_state) wait(ctx context.Context) bool {
+    p.mutx.Lock()
+    resumed := p.resumed
+    p.mutx.Unlock()
+
+    select {
+    case <- resumed:
+        return true
+    case <- ctx.Done():
+        return false
+    }
+}
+
+
+// Calls timeout if the call is still paused after the given time
+func (p *pause_state) start_timer(after time.Duration, timeout func()) {
+    p.mutx.Lock()
+    defer p.mutx.Unlock()
+
+    if p.timer != nil {
+        p.timer.Stop()
+    }
+    var timer *time.Timer
+    timer = time.AfterFunc(after, func() {
+        // Resuming and pausing again replaces the timer, so make sure this is still the current one
+        p.mutx.Lock()
+        current := p.paused && p.timer == timer
+        p.timer = nil
+        p.mutx.Unlock()
+
+        if current {
+            timeout()
+        }
+    })
+    p.timer = timer
+}
+
+
+func (p *pause_state) stop_timer() {
+    p.mutx.Lock()
+    defer p.mutx.Unlock()
+
+    if p.timer != nil {
+        p.timer.Stop()
+        p.timer = nil
+    }
+}
+
+
+// Called by the sending threads before each packet, holds them while the call is paused
+// Returns false if the track was cancelled while paused, e.g. by a skip or leaving the call
+func wait_if_paused(pause *pause_state, vc VoiceConn, ctx context.Context) bool {
+    if !pause.is_paused() {
+        return true
+    }
+
+    // Trail off with silence and stop speaking, so discord does not show the bot as talking while nothing plays
+    for i := 0; i < silence_frames; i++ {
+        select {
+        case <- ctx.Done():
+            return false
+        case vc.opus_send() <- opus_silence:
+        }
+    }
+    vc.speaking(false)
+    log.Printf("paused\n")
+
+    if !pause.wait(ctx) {
+        return false
+    }
+
+    // Frames start again from the next one sent, so only the speaking state needs putting back
+    vc.speaking(true)
+    log.Printf("resumed\n")
+    return true
+}
+
+
+func set_paused(s *discordgo.Session, m *discordgo.MessageCreate, val bool) {
+    p := get_player(m.GuildID)
+    if p == nil {
+        s.ChannelMessageSend(m.ChannelID, "I'm not in a call, you can't tell me what to do with my life!")
+        return
+    }
+
+    title, err := p.set_paused(val)
+    if err != nil {
+        s.ChannelMessageSend(m.ChannelID, err.Error())
+        return
+    }
+
+    switch val {
+    case false:
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Resumed %s", title))
+    case true:
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Paused %s, type `%cresume` to resume playing", title, settings.cmd_prefix))
+
+        // Give up on the call if nobody resumes it
+        if settings.pause_timeout > 0 {
+            channel_id := m.ChannelID
+            p.pause.start_timer(settings.pause_timeout, func() {
+                log.Printf("paused for too long in %s, leaving\n", p.guild_id)
+                p.leave()
+                s.ChannelMessageSend(channel_id, fmt.Sprintf("Left the call after being paused for %s", settings.pause_timeout))
+            })
+        }
+    }
+}
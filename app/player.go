@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"layeh.com/gopus"
+)
+
+// One for each guild the bot is in a call in
+// The run goroutine owns the queue and whatever is playing, everything else asks it to do things by sending commands
+type Player struct {
+    guild_id string
+    vc VoiceConn
+    // Sends a message to a text channel
+    message func(channel_id string, msg string)
+    // Shared with the sending threads, which block on it while paused
+    pause *pause_state
+    cmds chan player_command
+    // Each playthrough sends its result here when it ends
+    finished chan playback_result
+    // Closed once the player has left the call
+    done chan struct{}
+
+    // Everything below is only touched by the run goroutine
+    queue []*Track
+    // The next track in the queue, being readied while the current one plays
+    prefetch *Prefetch
+    // The current playthrough, nil when nothing is playing
+    current *playback
+    // The voice channel the bot is in, as far as it knows
+    channel_id string
+    // Where tracks are announced, the channel of whoever started the queue playing
+    txt_chan string
+    leaving bool
+    // Kept between tracks for gapless playback and crossfades
+    opus_enc *gopus.Encoder
+    speaking bool
+    // The end of the previous track, held back to be mixed into the start of the next one
+    crossfade_tail [][]int16
+    // Running while nothing is playing, and while nobody else is in the channel
+    idle_timeout *player_timeout
+    alone_timeout *player_timeout
+    // Set when playback was paused because everyone left, so it resumes when someone comes back
+    alone_paused bool
+}
+
+// Something for the run goroutine to do, each command replies on its own channel
+type player_command interface {
+    apply(p *Player)
+}
+
+type player_enqueue struct {
+    tracks []*Track
+    txt_chan string
+    // False if the player is leaving and the tracks were not queued
+    reply chan bool
+}
+
+type player_skip struct {
+    reply chan player_reply
+}
+
+type player_pause struct {
+    paused bool
+    reply chan player_reply
+}
+
+type player_seek struct {
+    // Absolute like 2:30, or relative to the current position like +30s
+    argument string
+    reply chan player_reply
+}
+
+// Starts the current track again from where it is, picking up changed filters or normalization
+type player_restart struct {
+    reason string
+    reply chan player_reply
+}
+
+type player_status struct {
+    reply chan []Track
+}
+
+type player_leave struct {}
+
+// What a command did, err is worded to be shown to users
+type player_reply struct {
+    title string
+    position time.Duration
+    err error
+}
+
+var (
+    players = map[string]*Player{}
+    // Only guards the players map itself, the state of each player belongs to its run goroutine
+    players_mutx sync.Mutex
+
+    err_nothing_playing = errors.New("Nothing is currently playing")
+    // Cause given when the current track is stopped by +skip
+    err_skipped = errors.New("Skipped")
+)
+
+
+// The player for a guild, nil if the bot is not in a call there
+func get_player(guild_id string) *Player {
+    players_mutx.Lock()
+    defer players_mutx.Unlock()
+    return players[guild_id]
+}
+
+
+// txt_chan is where the player says why it left, if it leaves by itself
+func join_voice(s *discordgo.Session, guild_id string, vc_id string, txt_chan string) (*Player, error) {
+    players_mutx.Lock()
+    defer players_mutx.Unlock()
+
+    // Check if the bot is already in a call
+    if _, exists := players[guild_id]; exists {
+        log.Printf("already in a voice call\n")
+        return nil, fmt.Errorf("already in a voice call, use `%cmove` to bring me to yours", settings.cmd_prefix)
+    }
+
+    // Join the new voice channel
+    vc, err := s.ChannelVoiceJoin(guild_id, vc_id, false, true)
+    if err != nil {
+        return nil, fmt.Errorf("unable to join voice call: %s\n", err.Error())
+    }
+
+    p := new_player(guild_id, discord_voice{vc: vc}, vc_id, txt_chan, func(channel_id string, msg string) {
+        send_message(s, channel_id, msg)
+    })
+    players[guild_id] = p
+
+    log.Printf("Joined a voice call in %s\n", guild_id)
+    return p, nil
+}
+
+
+// Starts the run goroutine of a player for a connection that has already been made
+func new_player(guild_id string, vc VoiceConn, vc_id string, txt_chan string, message func(channel_id string, msg string)) *Player {
+    p := &Player{
+        guild_id: guild_id,
+        vc: vc,
+        channel_id: vc_id,
+        txt_chan: txt_chan,
+        message: message,
+        pause: new_pause_state(),
+        cmds: make(chan player_command),
+        finished: make(chan playback_result),
+        done: make(chan struct{}),
+    }
+    go p.run()
+    return p
+}
+
+
+func leave_voice(guild_id string) {
+    p := get_player(guild_id)
+    if p == nil {
+        return
+    }
+    p.leave()
+}
+
+
+// Handles commands one at a time until the player has left and the last track has stopped
+func (p *Player) run() {
+    defer p.close()
+
+    // Nothing is playing yet, so the idle timeout starts straight away
+    p.update_idle_timeout()
+
+    for !p.leaving || p.current != nil {
+        select {
+        case cmd := <- p.cmds:
+            cmd.apply(p)
+        case result := <- p.finished:
+            p.track_finished(result)
+        }
+    }
+}
+
+
+// Leaves the call and frees everything the player still holds
+func (p *Player) close() {
+    p.pause.stop_timer()
+    p.idle_timeout.stop()
+    p.alone_timeout.stop()
+
+    // Stop preparing the next track, and free anything still held by tracks that will never be played
+    if p.prefetch != nil {
+        p.prefetch.discard()
+        p.prefetch = nil
+    }
+    release_tracks(p.queue)
+    p.queue = nil
+
+    // Disconnect, close channel, and close web socket
+    p.vc.disconnect()
+
+    // Taken out of the map before done is closed, so whoever waited on leave can join again straight away
+    players_mutx.Lock()
+    delete(players, p.guild_id)
+    players_mutx.Unlock()
+    close(p.done)
+
+    log.Printf("Left a voice call in %s\n", p.guild_id)
+}
+
+
+// Sends a command to the run goroutine, returning false if the player has already left
+func (p *Player) send(cmd player_command) bool {
+    select {
+    case p.cmds <- cmd:
+        return true
+    case <- p.done:
+        return false
+    }
+}
+
+
+// Adds tracks to the end of the queue, starting playback if nothing is playing
+// Returns false if the player is leaving, in which case the tracks are left to the caller
+func (p *Player) enqueue(tracks []*Track, txt_chan string) bool {
+    cmd := player_enqueue{tracks: tracks, txt_chan: txt_chan, reply: make(chan bool, 1)}
+    if !p.send(cmd) {
+        return false
+    }
+    return <-cmd.reply
+}
+
+
+// Stops the current track, returning its title
+func (p *Player) skip() (string, error) {
+    cmd := player_skip{reply: make(chan player_reply, 1)}
+    return p.ask(cmd, cmd.reply)
+}
+
+
+func (p *Player) set_paused(paused bool) (string, error) {
+    cmd := player_pause{paused: paused, reply: make(chan player_reply, 1)}
+    return p.ask(cmd, cmd.reply)
+}
+
+
+// Moves playback of the current track, returning its title and where it moved to
+func (p *Player) seek(argument string) (string, time.Duration, error) {
+    cmd := player_seek{argument: argument, reply: make(chan player_reply, 1)}
+    if !p.send(cmd) {
+        return "", 0, err_nothing_playing
+    }
+    r := <-cmd.reply
+    return r.title, r.position, r.err
+}
+
+
+func (p *Player) restart(reason string) {
+    cmd := player_restart{reason: reason, reply: make(chan player_reply, 1)}
+    p.ask(cmd, cmd.reply)
+}
+
+
+// A copy of the queue, including the currently playing track
+func (p *Player) status() []Track {
+    cmd := player_status{reply: make(chan []Track, 1)}
+    if !p.send(cmd) {
+        return nil
+    }
+    return <-cmd.reply
+}
+
+
+// Stops playback and leaves the call, returning once the player is gone
+func (p *Player) leave() {
+    p.send(player_leave{})
+    <-p.done
+}
+
+
+func (p *Player) ask(cmd player_command, reply chan player_reply) (string, error) {
+    if !p.send(cmd) {
+        return "", err_nothing_playing
+    }
+    r := <-reply
+    return r.title, r.err
+}
+
+
+func (c player_enqueue) apply(p *Player) {
+    if p.leaving {
+        c.reply <- false
+        return
+    }
+
+    p.queue = append(p.queue, c.tracks...)
+    log.Printf("added %d song(s) to queue\n", len(c.tracks))
+    c.reply <- true
+
+    // If nothing is playing, start playing
+    if p.current == nil {
+        log.Printf("nothing playing - starting queue\n")
+        p.txt_chan = c.txt_chan
+        p.start_track(false)
+        return
+    }
+
+    // The new tracks may be next in line, so make sure the right one is being prefetched
+    p.update_prefetch()
+}
+
+
+func (c player_skip) apply(p *Player) {
+    if p.current == nil {
+        c.reply <- player_reply{err: err_nothing_playing}
+        return
+    }
+
+    // From here, the playthrough ends and track_finished moves on to the next track
+    p.current.stop(err_skipped)
+    c.reply <- player_reply{title: p.current.track.title}
+    log.Printf("skip command executed\n")
+}
+
+
+func (c player_pause) apply(p *Player) {
+    if p.current == nil {
+        c.reply <- player_reply{err: err_nothing_playing}
+        return
+    }
+
+    if !p.pause.set(c.paused) {
+        if c.paused {
+            c.reply <- player_reply{err: errors.New("Already paused")}
+        } else {
+            c.reply <- player_reply{err: errors.New("Not paused")}
+        }
+        return
+    }
+    c.reply <- player_reply{title: p.current.track.title}
+}
+
+
+func (c player_seek) apply(p *Player) {
+    if p.current == nil {
+        c.reply <- player_reply{err: err_nothing_playing}
+        return
+    }
+
+    track := p.current.track
+    if track.live {
+        c.reply <- player_reply{err: errors.New("Live streams can not be seeked")}
+        return
+    }
+
+    position := p.current.position()
+    target, err := parse_seek(c.argument, position)
+    if err != nil {
+        c.reply <- player_reply{err: fmt.Errorf("Invalid time '%s', use something like `2:30`, `+30s` or `-10s`", c.argument)}
+        return
+    }
+    if track.duration > 0 && target >= track.duration {
+        c.reply <- player_reply{err: fmt.Errorf("%s is only %s long", track.title, track.duration)}
+        return
+    }
+
+    p.current.restart(target)
+    c.reply <- player_reply{title: track.title, position: target}
+    log.Printf("seek command executed: %s -> %s\n", position, target)
+}
+
+
+func (c player_restart) apply(p *Player) {
+    if p.current == nil {
+        c.reply <- player_reply{err: err_nothing_playing}
+        return
+    }
+
+    log.Printf("%s, restarting track\n", c.reason)
+    p.current.restart(p.current.position())
+    c.reply <- player_reply{title: p.current.track.title}
+}
+
+
+func (c player_status) apply(p *Player) {
+    queue := make([]Track, 0, len(p.queue))
+    for _, track := range p.queue {
+        queue = append(queue, *track)
+    }
+    c.reply <- queue
+}
+
+
+func (c player_leave) apply(p *Player) {
+    // The run loop ends once the current track has stopped
+    p.leaving = true
+    if p.current != nil {
+        p.current.stop(fmt.Errorf("Disconnected"))
+    }
+    if p.prefetch != nil {
+        p.prefetch.discard()
+        p.prefetch = nil
+    }
+}
+
+
+// Starts a playthrough of the track at the front of the queue
+// seeking is set when the same track is restarting at a new position, so it is not announced again
+func (p *Player) start_track(seeking bool) {
+    track := p.queue[0]
+
+    // Filters and normalization are fixed for each playthrough, changing them restarts the track
+    gs := get_guild_settings(p.guild_id)
+    graph := audio_graph(gs)
+
+    // Gapless playback keeps the same encoder going from track to track, so there is no break in the audio
+    if !gs.seamless() {
+        p.opus_enc = nil
+    }
+
+    // Tell discord we want to start speaking, unless still speaking from the last track
+    if !p.speaking {
+        p.vc.speaking(true)
+        p.speaking = true
+    }
+
+    pb := &playback{
+        guild_id: p.guild_id,
+        vc: p.vc,
+        pause: p.pause,
+        track: track,
+        gs: gs,
+        graph: graph,
+        seeking: seeking,
+        opus_enc: p.opus_enc,
+        fade_in: p.crossfade_tail,
+        tempo: filter_tempo(gs.filters),
+    }
+    p.crossfade_tail = nil
+    pb.bts_ctx, pb.bts_cancel = context.WithCancel(context.Background())
+    pb.eas_ctx, pb.eas_cancel = context.WithCancelCause(context.Background())
+
+    // Use the prefetched track if it is the one about to play
+    // Otherwise leave it be, after a seek it is still the right one for the next track and update_prefetch throws away stale ones
+    // A prefetch is no good if the volume, filters or normalization have changed since it started
+    if p.prefetch != nil && p.prefetch.track == track && (!p.prefetch.passthrough || can_passthrough(p.guild_id)) && p.prefetch.graph == graph {
+        pb.prefetch = p.prefetch
+        p.prefetch = nil
+        // The prefetched ffmpeg process is already running under the prefetch context
+        pb.ffm_ctx, pb.ffm_cancel = pb.prefetch.ctx, pb.prefetch.cancel
+    } else {
+        pb.ffm_ctx, pb.ffm_cancel = context.WithCancel(context.Background())
+    }
+
+    p.current = pb
+    p.update_idle_timeout()
+
+    // Start getting the next track ready while this one plays
+    p.update_prefetch()
+
+    txt_chan := p.txt_chan
+    announce := func(msg string) {
+        p.message(txt_chan, msg)
+    }
+    go func() {
+        p.finished <- pb.play(announce)
+    }()
+}
+
+
+// Moves on once a playthrough has ended, to the same track again after a seek or to the next one in the queue
+func (p *Player) track_finished(r playback_result) {
+    pb := r.pb
+    p.current = nil
+    p.opus_enc = r.opus_enc
+    if r.source != nil {
+        pb.track.source = r.source
+    }
+
+    // Only a track that ended by itself fades into the next one, skips and seeks cut straight over
+    finished := r.err == nil && errors.Is(r.cause, err_song_finished)
+    if finished {
+        p.crossfade_tail = r.tail
+    }
+
+    // A seek plays the same track again from the new position, keeping its place in the queue
+    var seek *seek_request
+    if r.err == nil && errors.As(r.cause, &seek) && !p.leaving {
+        log.Printf("seeking to %s\n", seek.position)
+        pb.track.start = seek.position
+        p.start_track(true)
+        return
+    }
+
+    // Tell discord we are done speaking, unless going straight on into the next track
+    if !pb.gs.seamless() || !finished || len(p.queue) < 2 || p.leaving {
+        err := p.vc.speaking(false)
+        if err != nil {
+            log.Printf("problem stopping speaking: %s\n", err.Error())
+        }
+        p.speaking = false
+    }
+
+    // Skipping a paused track moves on to the next one playing, and resuming also stops the pause timeout
+    if errors.Is(r.cause, err_skipped) {
+        p.pause.set(false)
+        p.alone_paused = false
+    }
+
+    // Remove from the queue
+    if len(p.queue) > 0 && p.queue[0] == pb.track {
+        release_track(p.queue[0])
+        p.queue = p.queue[1:]
+    }
+
+    if p.leaving {
+        return
+    }
+
+    // Nothing left to play, so there is nothing left to be paused either
+    if len(p.queue) == 0 {
+        p.pause.set(false)
+        p.alone_paused = false
+        p.crossfade_tail = nil
+        p.update_prefetch()
+        p.update_idle_timeout()
+        return
+    }
+    p.start_track(false)
+}
+
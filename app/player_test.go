@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Stands in for discord, the test reads each packet itself so playback only moves as fast as the test lets it
+type fake_voice struct {
+    packets chan []byte
+    moves chan string
+    speaking_calls chan bool
+    disconnected chan struct{}
+}
+
+// Generates a sine wave as raw PCM, in place of a real track
+type sine_source struct {
+    frames int
+    released atomic.Int32
+}
+
+// Has to be resolved into a sine source before it can be played, like a video queued from a playlist
+type unresolved_source struct {
+    resolved *sine_source
+    resolves atomic.Int32
+}
+
+// Also offers its audio as ready made Opus packets, like a youtube track with an Opus format
+type opus_sine_source struct {
+    *sine_source
+}
+
+// Hands out one 20ms CELT packet per frame, all starting with the same TOC byte
+type test_opus_reader struct {
+    sent int
+    total int
+}
+
+const (
+    // TOC byte for a single 20ms CELT frame, which can not be mistaken for the packets gopus makes from the sine wave
+    test_opus_toc byte = 19 << 3
+
+    // Long enough to fail rather than hang, short enough that nothing legitimate comes near it
+    test_timeout time.Duration = 5 * time.Second
+    // How long to watch for packets that should not be sent
+    test_quiet time.Duration = 100 * time.Millisecond
+)
+
+
+func TestMain(m *testing.M) {
+    log.SetOutput(io.Discard)
+
+    // There is no ffmpeg here, the sine sources are already PCM so all that is left to do is skip to the start
+    decode_pcm = func(stream io.ReadCloser, start time.Duration, graph string, ctx context.Context) (io.ReadCloser, error) {
+        skip := int64(start / audio_frame_duration) * int64(audio_max_bytes)
+        io.CopyN(io.Discard, stream, skip)
+        return stream, nil
+    }
+
+    os.Exit(m.Run())
+}
+
+
+func new_fake_voice() *fake_voice {
+    return &fake_voice{
+        packets: make(chan []byte),
+        moves: make(chan string, 10),
+        speaking_calls: make(chan bool, 100),
+        disconnected: make(chan struct{}),
+    }
+}
+
+
+func (f *fake_voice) opus_send() chan<- []byte {
+    return f.packets
+}
+
+
+func (f *fake_voice) speaking(speaking bool) error {
+    f.speaking_calls <- speaking
+    return nil
+}
+
+
+func (f *fake_voice) move(channel_id string) error {
+    f.moves <- channel_id
+    return nil
+}
+
+
+func (f *fake_voice) disconnect() {
+    close(f.disconnected)
+}
+
+
+// Makes a player on a fake connection, which leaves when the test ends
+func new_test_player(t *testing.T) (*Player, *fake_voice, chan string) {
+    vc := new_fake_voice()
+    msgs := make(chan string, 100)
+    p := new_player(t.Name(), vc, "voice", "text", func(channel_id string, msg string) {
+        msgs <- msg
+    })
+    t.Cleanup(p.leave)
+
+    // Guild settings are kept by guild ID, so start each test from the defaults
+    update_guild_settings(t.Name(), func(gs *GuildSettings) {
+        *gs = default_guild_settings()
+    })
+    return p, vc, msgs
+}
+
+
+func new_sine_track(title string, frames int) (*Track, *sine_source) {
+    src := &sine_source{frames: frames}
+    track := &Track{
+        id: "test:" + title,
+        title: title,
+        duration: time.Duration(frames) * audio_frame_duration,
+        requester: "tester",
+        source: src,
+    }
+    return track, src
+}
+
+
+func (s *sine_source) open() (io.ReadCloser, error) {
+    samples := make([]int16, s.frames*audio_frame_size*audio_chan)
+    for i := 0; i < s.frames*audio_frame_size; i++ {
+        v := int16(8000 * math.Sin(2*math.Pi*440*float64(i)/float64(audio_sample_rate)))
+        for c := 0; c < audio_chan; c++ {
+            samples[i*audio_chan+c] = v
+        }
+    }
+
+    var buf bytes.Buffer
+    binary.Write(&buf, binary.LittleEndian, samples)
+    return io.NopCloser(&buf), nil
+}
+
+
+func (s *sine_source) release() {
+    s.released.Add(1)
+}
+
+
+func (o opus_sine_source) open_opus() (OpusReader, error) {
+    return &test_opus_reader{total: o.frames}, nil
+}
+
+
+func (r *test_opus_reader) read_packet() ([]byte, error) {
+    if r.sent >= r.total {
+        return nil, io.EOF
+    }
+    r.sent++
+    return []byte{test_opus_toc, byte(r.sent)}, nil
+}
+
+
+func (r *test_opus_reader) Close() error {
+    return nil
+}
+
+
+func (u *unresolved_source) resolve() (Source, error) {
+    u.resolves.Add(1)
+    return u.resolved, nil
+}
+
+
+func (u *unresolved_source) open() (io.ReadCloser, error) {
+    return nil, errors.New("opened without being resolved")
+}
+
+
+// Reads the next n packets, failing if any are silence
+func (f *fake_voice) read_audio(t *testing.T, n int) {
+    t.Helper()
+    for i := 0; i < n; i++ {
+        packet := f.next_packet(t)
+        if is_silence(packet) {
+            t.Fatalf("packet %d of %d was silence", i+1, n)
+        }
+    }
+}
+
+
+func (f *fake_voice) next_packet(t *testing.T) []byte {
+    t.Helper()
+    select {
+    case packet := <- f.packets:
+        return packet
+    case <- time.After(test_timeout):
+        t.Fatalf("timed out waiting for a packet")
+        return nil
+    }
+}
+
+
+// Reads audio packets until the player stops speaking, returning how many there were
+func (f *fake_voice) read_until_quiet(t *testing.T) int {
+    t.Helper()
+    n := 0
+    for {
+        select {
+        case packet := <- f.packets:
+            if is_silence(packet) {
+                t.Fatalf("got silence after %d packets", n)
+            }
+            n++
+        case speaking := <- f.speaking_calls:
+            if speaking {
+                t.Fatalf("started speaking again after %d packets", n)
+            }
+            return n
+        case <- time.After(test_timeout):
+            t.Fatalf("timed out after %d packets", n)
+        }
+    }
+}
+
+
+func (f *fake_voice) expect_speaking(t *testing.T, want bool) {
+    t.Helper()
+    select {
+    case speaking := <- f.speaking_calls:
+        if speaking != want {
+            t.Fatalf("speaking set to %t, expected %t", speaking, want)
+        }
+    case <- time.After(test_timeout):
+        t.Fatalf("timed out waiting for speaking to be set to %t", want)
+    }
+}
+
+
+// Makes sure nothing is sent for a little while
+func (f *fake_voice) expect_quiet(t *testing.T) {
+    t.Helper()
+    select {
+    case <- f.packets:
+        t.Fatalf("got a packet when nothing should be playing")
+    case speaking := <- f.speaking_calls:
+        t.Fatalf("speaking set to %t when nothing should be playing", speaking)
+    case <- time.After(test_quiet):
+    }
+}
+
+
+func expect_message(t *testing.T, msgs chan string, prefix string) {
+    t.Helper()
+    select {
+    case msg := <- msgs:
+        if !strings.HasPrefix(msg, prefix) {
+            t.Fatalf("got message %q, expected one starting %q", msg, prefix)
+        }
+    case <- time.After(test_timeout):
+        t.Fatalf("timed out waiting for message %q", prefix)
+    }
+}
+
+
+func expect_released(t *testing.T, src *sine_source) {
+    t.Helper()
+    deadline := time.Now().Add(test_timeout)
+    for src.released.Load() == 0 {
+        if time.Now().After(deadline) {
+            t.Fatalf("track was never released")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    if n := src.released.Load(); n != 1 {
+        t.Fatalf("track released %d times", n)
+    }
+}
+
+
+func is_silence(packet []byte) bool {
+    return bytes.Equal(packet, opus_silence)
+}
+
+
+func TestPlayToEnd(t *testing.T) {
+    p, vc, msgs := new_test_player(t)
+    track, src := new_sine_track("a", 25)
+
+    if !p.enqueue([]*Track{track}, "text") {
+        t.Fatalf("enqueue refused")
+    }
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: a")
+
+    if n := vc.read_until_quiet(t); n != 25 {
+        t.Fatalf("sent %d packets, expected 25", n)
+    }
+    expect_message(t, msgs, "Stopped playing 'a' - Song finished")
+    expect_released(t, src)
+    vc.expect_quiet(t)
+
+    if queue := p.status(); len(queue) != 0 {
+        t.Fatalf("queue has %d tracks left", len(queue))
+    }
+}
+
+
+func TestSkip(t *testing.T) {
+    p, vc, msgs := new_test_player(t)
+    long, long_src := new_sine_track("long", 1000)
+    short, _ := new_sine_track("short", 10)
+
+    p.enqueue([]*Track{long, short}, "text")
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: long")
+    vc.read_audio(t, 5)
+
+    title, err := p.skip()
+    if err != nil || title != "long" {
+        t.Fatalf("skip gave %q, %v", title, err)
+    }
+    expect_message(t, msgs, "Stopped playing 'long' - Skipped")
+    expect_released(t, long_src)
+
+    // Onto the next track, which plays all the way through
+    vc.expect_speaking(t, false)
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: short")
+    if n := vc.read_until_quiet(t); n != 10 {
+        t.Fatalf("sent %d packets of the next track, expected 10", n)
+    }
+
+    if _, err := p.skip(); err != err_nothing_playing {
+        t.Fatalf("skipping with nothing playing gave %v", err)
+    }
+}
+
+
+func TestPauseResume(t *testing.T) {
+    p, vc, msgs := new_test_player(t)
+    track, _ := new_sine_track("a", 100)
+
+    p.enqueue([]*Track{track}, "text")
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: a")
+    vc.read_audio(t, 5)
+
+    if _, err := p.set_paused(true); err != nil {
+        t.Fatalf("pause: %v", err)
+    }
+    if _, err := p.set_paused(true); err == nil {
+        t.Fatalf("pausing twice did not fail")
+    }
+
+    // A packet may already have been on its way, after that it trails off with silence and stops speaking
+    played := 5
+    packet := vc.next_packet(t)
+    if !is_silence(packet) {
+        played++
+        packet = vc.next_packet(t)
+    }
+    for i := 1; i < silence_frames; i++ {
+        if !is_silence(packet) {
+            t.Fatalf("expected %d silence frames, got audio after %d", silence_frames, i)
+        }
+        packet = vc.next_packet(t)
+    }
+    if !is_silence(packet) {
+        t.Fatalf("expected %d silence frames", silence_frames)
+    }
+    vc.expect_speaking(t, false)
+    vc.expect_quiet(t)
+
+    // Resuming carries on from where it was, so the whole track is still heard
+    if _, err := p.set_paused(false); err != nil {
+        t.Fatalf("resume: %v", err)
+    }
+    vc.expect_speaking(t, true)
+    if n := vc.read_until_quiet(t); played+n != 100 {
+        t.Fatalf("sent %d packets in total, expected 100", played+n)
+    }
+    expect_message(t, msgs, "Stopped playing 'a' - Song finished")
+}
+
+
+func TestSkipWhilePaused(t *testing.T) {
+    set_test_settings(t, func(s *Settings) {
+        s.pause_timeout = 200 * time.Millisecond
+    })
+    p, vc, msgs := new_test_player(t)
+    first, _ := new_sine_track("first", 1000)
+    second, _ := new_sine_track("second", 100)
+
+    p.enqueue([]*Track{first, second}, "text")
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: first")
+    vc.read_audio(t, 5)
+
+    if _, err := p.set_paused(true); err != nil {
+        t.Fatalf("pause: %v", err)
+    }
+    for silent := 0; silent < silence_frames; {
+        if is_silence(vc.next_packet(t)) {
+            silent++
+        }
+    }
+    vc.expect_speaking(t, false)
+    if _, err := p.skip(); err != nil {
+        t.Fatalf("skip: %v", err)
+    }
+    expect_message(t, msgs, "Stopped playing 'first' - Skipped")
+
+    // The next track really plays, rather than being announced and then sitting paused
+    expect_message(t, msgs, "Now Playing: second")
+    vc.expect_speaking(t, false)
+    vc.expect_speaking(t, true)
+    vc.read_audio(t, 20)
+
+    // Nor does the pause timeout leave partway through it
+    time.Sleep(2 * settings.pause_timeout)
+    select {
+    case <- vc.disconnected:
+        t.Fatalf("left the call after skipping a paused track")
+    default:
+    }
+    if _, err := p.set_paused(false); err == nil {
+        t.Fatalf("still paused after skipping")
+    }
+    vc.read_audio(t, 10)
+}
+
+
+func TestDisconnect(t *testing.T) {
+    p, vc, msgs := new_test_player(t)
+    playing, playing_src := new_sine_track("playing", 1000)
+    queued, queued_src := new_sine_track("queued", 10)
+
+    p.enqueue([]*Track{playing, queued}, "text")
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: playing")
+    vc.read_audio(t, 5)
+
+    p.leave()
+    select {
+    case <- vc.disconnected:
+    default:
+        t.Fatalf("leave returned before disconnecting")
+    }
+    expect_message(t, msgs, "Stopped playing 'playing' - Disconnected")
+    vc.expect_speaking(t, false)
+    expect_released(t, playing_src)
+    expect_released(t, queued_src)
+
+    if p.enqueue([]*Track{queued}, "text") {
+        t.Fatalf("enqueue accepted after leaving")
+    }
+}
+
+
+func TestDisconnectWhilePaused(t *testing.T) {
+    p, vc, msgs := new_test_player(t)
+    track, src := new_sine_track("a", 1000)
+
+    p.enqueue([]*Track{track}, "text")
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: a")
+    vc.read_audio(t, 5)
+
+    p.set_paused(true)
+    for {
+        if is_silence(vc.next_packet(t)) {
+            break
+        }
+    }
+    for i := 1; i < silence_frames; i++ {
+        vc.next_packet(t)
+    }
+    vc.expect_speaking(t, false)
+
+    p.leave()
+    expect_message(t, msgs, "Stopped playing 'a' - Disconnected")
+    expect_released(t, src)
+}
+
+
+func TestQueueAdvance(t *testing.T) {
+    p, vc, msgs := new_test_player(t)
+    var sources []*sine_source
+    for i, title := range []string{"one", "two", "three"} {
+        track, src := new_sine_track(title, 5+i)
+        sources = append(sources, src)
+        p.enqueue([]*Track{track}, "text")
+    }
+
+    for i, title := range []string{"one", "two", "three"} {
+        vc.expect_speaking(t, true)
+        expect_message(t, msgs, "Now Playing: "+title)
+        if n := vc.read_until_quiet(t); n != 5+i {
+            t.Fatalf("%s sent %d packets, expected %d", title, n, 5+i)
+        }
+        expect_message(t, msgs, "Stopped playing '"+title+"' - Song finished")
+        expect_released(t, sources[i])
+    }
+    vc.expect_quiet(t)
+}
+
+
+func TestSeek(t *testing.T) {
+    p, vc, msgs := new_test_player(t)
+    track, _ := new_sine_track("a", 100)
+
+    p.enqueue([]*Track{track}, "text")
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: a")
+    vc.read_audio(t, 10)
+
+    if _, _, err := p.seek("5"); err == nil {
+        t.Fatalf("seeking past the end did not fail")
+    }
+    _, target, err := p.seek("1")
+    if err != nil || target != time.Second {
+        t.Fatalf("seek gave %s, %v", target, err)
+    }
+
+    // The same track starts again half way through, without being announced again
+    // One packet from before the seek may already have been on its way
+    if n := vc.read_until_quiet(t); n != 50 && n != 51 {
+        t.Fatalf("sent %d packets after seeking, expected 50", n)
+    }
+    expect_message(t, msgs, "Stopped playing 'a' - Song finished")
+}
+
+
+func TestResolveOnce(t *testing.T) {
+    p, vc, msgs := new_test_player(t)
+    track, sine := new_sine_track("a", 100)
+    unresolved := &unresolved_source{resolved: sine}
+    track.source = unresolved
+
+    p.enqueue([]*Track{track}, "text")
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: a")
+    vc.read_audio(t, 10)
+
+    // Seeking plays the track again from the source resolved the first time
+    if _, _, err := p.seek("1"); err != nil {
+        t.Fatalf("seek: %v", err)
+    }
+    vc.read_audio(t, 10)
+    if n := unresolved.resolves.Load(); n != 1 {
+        t.Fatalf("resolved %d times, expected once", n)
+    }
+    if queue := p.status(); len(queue) != 1 || queue[0].source != Source(sine) {
+        t.Fatalf("the resolved source was not kept on the track")
+    }
+}
+
+
+func TestPassthroughSettingsChange(t *testing.T) {
+    p, vc, msgs := new_test_player(t)
+    track, sine := new_sine_track("a", 200)
+    track.source = opus_sine_source{sine}
+
+    expect_passthrough := func(n int, expected bool) {
+        t.Helper()
+        for i := 0; i < n; i++ {
+            if packet := vc.next_packet(t); (packet[0] == test_opus_toc) != expected {
+                t.Fatalf("packet %d: passthrough was %v, expected %v", i, !expected, expected)
+            }
+        }
+    }
+
+    p.enqueue([]*Track{track}, "text")
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: a")
+    expect_passthrough(5, true)
+
+    // Crossfade only changes the end of the track, so the packets carry on as they are
+    update_guild_settings(t.Name(), func(gs *GuildSettings) {
+        gs.crossfade = 5 * audio_frame_duration
+    })
+    expect_passthrough(20, true)
+
+    // A volume change has to restart the track as transcoded audio, one packet may already have been on its way
+    update_guild_settings(t.Name(), func(gs *GuildSettings) {
+        gs.volume = 50
+    })
+    if packet := vc.next_packet(t); packet[0] == test_opus_toc {
+        expect_passthrough(1, false)
+    }
+    expect_passthrough(20, false)
+
+    // Switching over is not announced as a new track
+    select {
+    case msg := <- msgs:
+        t.Fatalf("got message %q", msg)
+    default:
+    }
+}
+
+
+func TestGapless(t *testing.T) {
+    p, vc, msgs := new_test_player(t)
+    update_guild_settings(t.Name(), func(gs *GuildSettings) {
+        gs.gapless = true
+    })
+    first, _ := new_sine_track("first", 10)
+    second, _ := new_sine_track("second", 10)
+
+    // Speaking carries straight on from one track into the next
+    p.enqueue([]*Track{first, second}, "text")
+    vc.expect_speaking(t, true)
+    if n := vc.read_until_quiet(t); n != 20 {
+        t.Fatalf("sent %d packets, expected 20", n)
+    }
+    expect_message(t, msgs, "Now Playing: first")
+    expect_message(t, msgs, "Stopped playing 'first' - Song finished")
+    expect_message(t, msgs, "Now Playing: second")
+}
+
+
+func TestCrossfade(t *testing.T) {
+    p, vc, _ := new_test_player(t)
+    update_guild_settings(t.Name(), func(gs *GuildSettings) {
+        gs.crossfade = 5 * audio_frame_duration
+    })
+    first, _ := new_sine_track("first", 20)
+    second, _ := new_sine_track("second", 20)
+
+    // The last 5 frames of the first track are mixed into the start of the second, rather than sent on their own
+    p.enqueue([]*Track{first, second}, "text")
+    vc.expect_speaking(t, true)
+    if n := vc.read_until_quiet(t); n != 35 {
+        t.Fatalf("sent %d packets, expected 35", n)
+    }
+}
+
+
+// Changes the settings for one test, putting them back once the player has gone
+func set_test_settings(t *testing.T, change func(*Settings)) {
+    old := settings
+    change(&settings)
+    t.Cleanup(func() {
+        settings = old
+    })
+}
+
+
+func TestIdleTimeout(t *testing.T) {
+    set_test_settings(t, func(s *Settings) {
+        s.idle_timeout = 50 * time.Millisecond
+    })
+    p, vc, msgs := new_test_player(t)
+    track, _ := new_sine_track("a", 10)
+
+    // Playing holds the timeout off, it only starts once the queue runs out
+    p.enqueue([]*Track{track}, "text")
+    vc.expect_speaking(t, true)
+    vc.read_audio(t, 5)
+    time.Sleep(2 * settings.idle_timeout)
+    if n := vc.read_until_quiet(t); n != 5 {
+        t.Fatalf("sent %d packets, expected 5", n)
+    }
+
+    expect_message(t, msgs, "Now Playing: a")
+    expect_message(t, msgs, "Stopped playing 'a'")
+    expect_message(t, msgs, "Left the call, nothing has played")
+    select {
+    case <- p.done:
+    case <- time.After(test_timeout):
+        t.Fatalf("player did not leave")
+    }
+}
+
+
+func TestAloneTimeout(t *testing.T) {
+    set_test_settings(t, func(s *Settings) {
+        s.alone_timeout = 200 * time.Millisecond
+    })
+    p, vc, msgs := new_test_player(t)
+    track, src := new_sine_track("a", 1000)
+
+    p.enqueue([]*Track{track}, "text")
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: a")
+    vc.read_audio(t, 5)
+
+    // Everyone leaving pauses playback, someone coming back resumes it
+    p.send(player_alone{alone: true})
+    expect_message(t, msgs, "Everyone left, pausing")
+    for !is_silence(vc.next_packet(t)) {
+    }
+    for i := 1; i < silence_frames; i++ {
+        vc.next_packet(t)
+    }
+    vc.expect_speaking(t, false)
+
+    p.send(player_alone{alone: false})
+    expect_message(t, msgs, "Someone is back, resuming")
+    vc.expect_speaking(t, true)
+    vc.read_audio(t, 5)
+
+    // Then left alone for good, the bot leaves once the grace period is up
+    p.send(player_alone{alone: true})
+    expect_message(t, msgs, "Everyone left, pausing")
+    select {
+    case <- p.done:
+    case <- time.After(test_timeout):
+        t.Fatalf("player did not leave")
+    }
+    expect_message(t, msgs, "Left the call, nobody else was in it")
+    expect_message(t, msgs, "Stopped playing 'a' - Disconnected")
+    expect_released(t, src)
+}
+
+
+func TestMove(t *testing.T) {
+    p, vc, msgs := new_test_player(t)
+    track, _ := new_sine_track("a", 50)
+
+    p.enqueue([]*Track{track}, "text")
+    vc.expect_speaking(t, true)
+    expect_message(t, msgs, "Now Playing: a")
+    vc.read_audio(t, 10)
+
+    if err := p.move("voice"); err == nil {
+        t.Fatalf("moving to the same channel did not fail")
+    }
+    if err := p.move("other"); err != nil {
+        t.Fatalf("move: %v", err)
+    }
+    if channel := <-vc.moves; channel != "other" {
+        t.Fatalf("moved to %q, expected other", channel)
+    }
+
+    // Discord confirming the move changes nothing, being dragged somewhere else is announced
+    p.send(player_moved{channel_id: "other"})
+    p.send(player_moved{channel_id: "dragged"})
+    expect_message(t, msgs, "I was moved to <#dragged>")
+
+    // Playback carries on where it was through both
+    if n := vc.read_until_quiet(t); n != 40 {
+        t.Fatalf("sent %d packets after moving, expected 40", n)
+    }
+    expect_message(t, msgs, "Stopped playing 'a' - Song finished")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+var (
+    playlist_id_regex = regexp.MustCompile(`[&?]list=([A-Za-z0-9_-]+)`)
+)
+
+const (
+    // Queue every entry in the playlist
+    playlist_mode_all string = "all"
+    // Queue the linked video and everything after it in the playlist
+    playlist_mode_from string = "from"
+    // Ignore the playlist and only queue the linked video
+    playlist_mode_one string = "one"
+)
+
+
+// Subset of the innertube "next" response, which is where youtube puts the contents of mixes
+type yt_mix_response struct {
+    Contents struct {
+        TwoColumnWatchNextResults struct {
+            Playlist struct {
+                Playlist struct {
+                    Title string `json:"title"`
+                    Contents []struct {
+                        PlaylistPanelVideoRenderer *struct {
+                            VideoID string `json:"videoId"`
+                            Title yt_search_text `json:"title"`
+                            ShortBylineText yt_search_text `json:"shortBylineText"`
+                            LengthText yt_search_text `json:"lengthText"`
+                        } `json:"playlistPanelVideoRenderer"`
+                    } `json:"contents"`
+                } `json:"playlist"`
+            } `json:"playlist"`
+        } `json:"twoColumnWatchNextResults"`
+    } `json:"contents"`
+}
+
+
+// Returns the playlist ID of a youtube link, or an empty string if the link is not for a playlist
+func playlist_id(link string) string {
+    if !is_youtube_link(link) {
+        return ""
+    }
+    matches := playlist_id_regex.FindStringSubmatch(link)
+    if matches == nil {
+        return ""
+    }
+    return matches[1]
+}
+
+
+// Returns the video ID that a playlist link points at, if any
+func playlist_video_id(link string) string {
+    u, err := url.Parse(link)
+    if err != nil {
+        return ""
+    }
+    if v := u.Query().Get("v"); v != "" {
+        return v
+    }
+    // youtu.be links keep the video ID in the path
+    if strings.HasSuffix(u.Host, "youtu.be") {
+        return strings.Trim(u.Path, "/")
+    }
+    return ""
+}
+
+
+// Fetches the videos in a youtube playlist or mix
+// The returned videos only have their metadata filled in, get_audio_stream resolves the rest when they are played
+func get_playlist(link string, mode string) ([]*youtube.Video, string, error) {
+    list_id := playlist_id(link)
+    video_id := playlist_video_id(link)
+
+    var videos []*youtube.Video
+    var title string
+    var err error
+
+    // Mixes are generated per user, so they can not be fetched like a normal playlist
+    if strings.HasPrefix(list_id, "RD") {
+        videos, title, err = get_mix(list_id, video_id)
+    } else {
+        videos, title, err = get_regular_playlist(link)
+    }
+    if err != nil {
+        return nil, "", classify_youtube_error(err)
+    }
+
+    // Skip everything before the linked video if asked to
+    if mode == playlist_mode_from && video_id != "" {
+        for i, v := range videos {
+            if v.ID == video_id {
+                videos = videos[i:]
+                break
+            }
+        }
+    }
+
+    if len(videos) == 0 {
+        return nil, "", fmt.Errorf("playlist '%s' is empty", title)
+    }
+
+    // Cap the number of entries so one command can not flood the queue
+    if len(videos) > settings.playlist_limit {
+        log.Printf("playlist '%s' capped from %d to %d entries\n", title, len(videos), settings.playlist_limit)
+        videos = videos[:settings.playlist_limit]
+    }
+
+    return videos, title, nil
+}
+
+
+func get_regular_playlist(link string) ([]*youtube.Video, string, error) {
+    client := youtube.Client{}
+
+    playlist, err := client.GetPlaylist(link)
+    if err != nil {
+        return nil, "", err
+    }
+
+    videos := []*youtube.Video{}
+    for _, entry := range playlist.Videos {
+        videos = append(videos, &youtube.Video{
+            ID: entry.ID,
+            Title: entry.Title,
+            Author: entry.Author,
+            Duration: entry.Duration,
+        })
+    }
+
+    return videos, playlist.Title, nil
+}
+
+
+func get_mix(list_id string, video_id string) ([]*youtube.Video, string, error) {
+    // Mix IDs are "RD" followed by the video the mix was generated from
+    if video_id == "" {
+        video_id = strings.TrimPrefix(list_id, "RD")
+    }
+
+    var data yt_mix_response
+    err := innertube_post(&http.Client{Timeout: 10 * time.Second}, "next", map[string]any{
+        "videoId": video_id,
+        "playlistId": list_id,
+    }, &data)
+    if err != nil {
+        return nil, "", fmt.Errorf("fetching mix: %s", err.Error())
+    }
+
+    mix := data.Contents.TwoColumnWatchNextResults.Playlist.Playlist
+    videos := []*youtube.Video{}
+    for _, item := range mix.Contents {
+        r := item.PlaylistPanelVideoRenderer
+        if r == nil || r.VideoID == "" {
+            continue
+        }
+        dur, _ := parse_timestamp(r.LengthText.String())
+        videos = append(videos, &youtube.Video{
+            ID: r.VideoID,
+            Title: r.Title.String(),
+            Author: r.ShortBylineText.String(),
+            Duration: dur,
+        })
+    }
+
+    return videos, mix.Title, nil
+}
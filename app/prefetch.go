@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+)
+
+// The next track in a queue, opened and partly decoded in the background while the current track plays
+type Prefetch struct {
+    track *Track
+    // Whether opus passthrough was allowed when the prefetch started, and the filters used if it was not
+    passthrough bool
+    graph string
+    // Cancelling this stops the prefetched ffmpeg process, so it becomes the call's ffm_ctx once the track starts
+    ctx context.Context
+    cancel context.CancelFunc
+    // Closed once everything below has been filled in
+    done chan struct{}
+
+    // Set when the track can use opus passthrough
+    opus_reader OpusReader
+    first_packet []byte
+
+    // Set when the track has to be transcoded
+    audio_stream io.ReadCloser
+    pcm io.ReadCloser
+
+    // Set if the track's source had to be resolved first
+    source Source
+    err error
+}
+
+// Reads from a buffer of already decoded audio, then carries on with the rest of the stream
+type buffered_pcm struct {
+    io.Reader
+    io.Closer
+}
+
+const (
+    // One second of PCM is decoded ahead of time, enough to cover ffmpeg starting up without holding much memory
+    prefetch_buffer_bytes int = audio_max_bytes * (audio_sample_rate / audio_frame_size)
+)
+
+
+func start_prefetch(track *Track, passthrough bool, graph string) *Prefetch {
+    p := &Prefetch{
+        track: track,
+        passthrough: passthrough,
+        graph: graph,
+        done: make(chan struct{}),
+    }
+    p.ctx, p.cancel = context.WithCancel(context.Background())
+
+    go func() {
+        defer close(p.done)
+        log.Printf("prefetching: %s\n", track.id)
+
+        // The queued track is only ever changed by the run goroutine, which picks up the resolved source once the track plays
+        resolved, err := resolve_track(track)
+        if err != nil {
+            p.err = err
+            return
+        }
+        if resolved.source != track.source {
+            p.source = resolved.source
+        }
+
+        // Same order as playback.play, passthrough first and transcoding if that is not possible
+        if passthrough {
+            p.opus_reader, p.first_packet = open_passthrough(resolved)
+            if p.opus_reader != nil {
+                return
+            }
+        }
+
+        p.audio_stream, p.err = resolved.source.open()
+        if p.err != nil {
+            return
+        }
+
+        pcm, err := decode_pcm(p.audio_stream, resolved.start, graph, p.ctx)
+        if err != nil {
+            p.audio_stream.Close()
+            p.audio_stream = nil
+            p.err = fmt.Errorf("converting audio -> pcm: %s", err.Error())
+            return
+        }
+
+        // Decode the start of the track now so audio is ready the moment the current track ends
+        // A short read just means the whole track fit in the buffer
+        buf := make([]byte, prefetch_buffer_bytes)
+        n, _ := io.ReadFull(pcm, buf)
+        p.pcm = &buffered_pcm{
+            Reader: io.MultiReader(bytes.NewReader(buf[:n]), pcm),
+            Closer: pcm,
+        }
+    }()
+
+    return p
+}
+
+
+// Stops a prefetch that will not be played, closing anything it opened
+func (p *Prefetch) discard() {
+    log.Printf("discarding prefetch: %s\n", p.track.id)
+    p.cancel()
+    go func() {
+        <-p.done
+        if p.opus_reader != nil {
+            p.opus_reader.Close()
+        }
+        if p.audio_stream != nil {
+            p.audio_stream.Close()
+        }
+        if p.pcm != nil {
+            p.pcm.Close()
+        }
+    }()
+}
+
+
+// Makes sure the track after the currently playing one is being prefetched, discarding any stale prefetch
+// Called by the run goroutine whenever the queue or the current track changes
+func (p *Player) update_prefetch() {
+    var next *Track
+    if p.current != nil && !p.leaving && len(p.queue) > 1 {
+        next = p.queue[1]
+    }
+
+    // Lets the end of the current track know whether it can crossfade into anything
+    if p.current != nil {
+        p.current.next_queued.Store(next != nil)
+    }
+
+    // Already working on the right track
+    if p.prefetch != nil && p.prefetch.track == next {
+        return
+    }
+
+    if p.prefetch != nil {
+        p.prefetch.discard()
+        p.prefetch = nil
+    }
+
+    // Live streams are not prefetched, the buffered audio would be stale by the time it played
+    if next != nil && !next.live {
+        p.prefetch = start_prefetch(next, can_passthrough(p.guild_id), audio_graph(get_guild_settings(p.guild_id)))
+    }
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Internet radio (Icecast / Shoutcast), HLS playlists, or any other audio served over plain HTTP
+type stream_source struct {
+    url string
+    // Called with the new title whenever the station's ICY now-playing metadata changes
+    on_title func(string)
+}
+
+// Strips ICY metadata blocks out of an audio stream, reporting the stream title whenever it changes
+type icy_reader struct {
+    body io.ReadCloser
+    // Number of audio bytes between each metadata block
+    metaint int
+    // Audio bytes left until the next metadata block
+    remaining int
+    title string
+    on_title func(string)
+}
+
+// Wraps an ffmpeg process so closing the reader also stops the process
+type process_reader struct {
+    io.ReadCloser
+    cancel context.CancelFunc
+}
+
+var (
+    // No overall timeout since streams are read for as long as they play, only the initial response is time limited
+    stream_http_client = &http.Client{
+        Transport: &http.Transport{
+            Proxy: http.ProxyFromEnvironment,
+            ResponseHeaderTimeout: 10 * time.Second,
+        },
+    }
+)
+
+const (
+    stream_prefix string = "url:"
+)
+
+
+func is_hls(u string, content_type string) bool {
+    content_type = strings.ToLower(content_type)
+    if strings.Contains(content_type, "apple.mpegurl") || strings.Contains(content_type, "x-mpegurl") {
+        return true
+    }
+    parsed, err := url.Parse(u)
+    return err == nil && strings.HasSuffix(strings.ToLower(parsed.Path), ".m3u8")
+}
+
+
+func is_audio_content(content_type string) bool {
+    content_type = strings.ToLower(content_type)
+    return content_type == "" ||
+        strings.HasPrefix(content_type, "audio/") ||
+        strings.HasPrefix(content_type, "application/ogg") ||
+        strings.HasPrefix(content_type, "application/octet-stream")
+}
+
+
+// Requests the stream, asking the server to include ICY metadata if it supports it
+func request_stream(u string) (*http.Response, error) {
+    req, err := http.NewRequest(http.MethodGet, u, nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Icy-MetaData", "1")
+
+    resp, err := stream_http_client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode != http.StatusOK {
+        resp.Body.Close()
+        return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+    }
+    return resp, nil
+}
+
+
+// Checks that a URL serves audio, and builds a live track for it
+func get_stream_track(u string, requester string, on_title func(string)) (*Track, error) {
+    resp, err := request_stream(u)
+    if err != nil {
+        return nil, err
+    }
+    resp.Body.Close()
+
+    content_type := resp.Header.Get("Content-Type")
+    if !is_hls(u, content_type) && !is_audio_content(content_type) {
+        return nil, fmt.Errorf("'%s' is not an audio stream (content type '%s')", u, content_type)
+    }
+
+    // Radio stations usually send their name, otherwise just show the link
+    title := resp.Header.Get("icy-name")
+    if title == "" {
+        title = u
+    }
+
+    return &Track{
+        id: stream_prefix + u,
+        title: title,
+        live: true,
+        requester: requester,
+        source: &stream_source{url: u, on_title: on_title},
+    }, nil
+}
+
+
+func (st *stream_source) open() (io.ReadCloser, error) {
+    resp, err := request_stream(st.url)
+    if err != nil {
+        return nil, err
+    }
+
+    // HLS is a playlist of segments rather than one stream, so let ffmpeg fetch the segments and hand back a single stream
+    if is_hls(st.url, resp.Header.Get("Content-Type")) {
+        resp.Body.Close()
+        return open_hls(st.url)
+    }
+
+    // Servers that support ICY metadata interleave it with the audio, which ffmpeg can not decode
+    metaint, err := strconv.Atoi(resp.Header.Get("icy-metaint"))
+    if err == nil && metaint > 0 {
+        return &icy_reader{
+            body: resp.Body,
+            metaint: metaint,
+            remaining: metaint,
+            on_title: st.on_title,
+        }, nil
+    }
+
+    return resp.Body, nil
+}
+
+
+func open_hls(u string) (io.ReadCloser, error) {
+    ctx, cancel := context.WithCancel(context.Background())
+
+    // Copy the audio out of the HLS segments without re-encoding, the normal pipeline decodes it afterwards
+    c := exec.CommandContext(ctx, "ffmpeg", "-loglevel", "error", "-i", u, "-vn", "-c:a", "copy", "-f", "mpegts", "pipe:1")
+    c.Stderr = os.Stderr
+
+    out, err := c.StdoutPipe()
+    if err != nil {
+        cancel()
+        return nil, fmt.Errorf("getting stdout: %s", err.Error())
+    }
+    err = c.Start()
+    if err != nil {
+        cancel()
+        return nil, fmt.Errorf("ffmpeg: %s", err.Error())
+    }
+    log.Printf("started ffmpeg hls command\n")
+
+    // Reap the process once it is done
+    go c.Wait()
+
+    return &process_reader{ReadCloser: out, cancel: cancel}, nil
+}
+
+
+func (p *process_reader) Close() error {
+    p.cancel()
+    return p.ReadCloser.Close()
+}
+
+
+func (r *icy_reader) Read(buf []byte) (int, error) {
+    // Time for a metadata block
+    if r.remaining == 0 {
+        err := r.read_metadata()
+        if err != nil {
+            return 0, err
+        }
+        r.remaining = r.metaint
+    }
+
+    // Never read past the start of the next metadata block
+    if len(buf) > r.remaining {
+        buf = buf[:r.remaining]
+    }
+    n, err := r.body.Read(buf)
+    r.remaining -= n
+    return n, err
+}
+
+
+func (r *icy_reader) read_metadata() error {
+    // The first byte is the length of the metadata block divided by 16
+    var length [1]byte
+    _, err := io.ReadFull(r.body, length[:])
+    if err != nil {
+        return err
+    }
+    if length[0] == 0 {
+        return nil
+    }
+
+    meta := make([]byte, int(length[0])*16)
+    _, err = io.ReadFull(r.body, meta)
+    if err != nil {
+        return err
+    }
+
+    title, found := parse_icy_title(string(meta))
+    if found && title != r.title {
+        r.title = title
+        if r.on_title != nil && title != "" {
+            r.on_title(title)
+        }
+    }
+    return nil
+}
+
+
+func (r *icy_reader) Close() error {
+    return r.body.Close()
+}
+
+
+// Pulls the StreamTitle out of an ICY metadata block, e.g. "StreamTitle='Artist - Song';StreamUrl='';"
+func parse_icy_title(meta string) (string, bool) {
+    meta = strings.TrimRight(meta, "\x00")
+    const key = "StreamTitle='"
+
+    start := strings.Index(meta, key)
+    if start < 0 {
+        return "", false
+    }
+    meta = meta[start+len(key):]
+
+    end := strings.Index(meta, "';")
+    if end < 0 {
+        end = strings.LastIndex(meta, "'")
+    }
+    if end < 0 {
+        return "", false
+    }
+    return meta[:end], true
+}
+
+
+// Handles `play [url]` for links that are not youtube
+func play_stream(s *discordgo.Session, m *discordgo.MessageCreate, u string) {
+    var track *Track
+    on_title := func(title string) {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Now playing on %s: %s", track.title, title))
+    }
+
+    track, err := get_stream_track(u, m.Author.Username, on_title)
+    if err != nil {
+        s.ChannelMessageSend(m.ChannelID, "Could not play that link, make sure it is an audio stream")
+        log.Printf("failed to get stream: %s\n", err.Error())
+        return
+    }
+    log.Printf("found audio stream: [%s] - [%s]\n", track.title, u)
+
+    enqueue_track(s, m, track)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Builds an ICY metadata block, padded out to a multiple of 16 bytes with its length byte in front
+func icy_block(meta string) []byte {
+    length := (len(meta) + 15) / 16
+    block := make([]byte, 1+length*16)
+    block[0] = byte(length)
+    copy(block[1:], meta)
+    return block
+}
+
+
+func TestStreamIcyMetadata(t *testing.T) {
+    audio := bytes.Repeat([]byte("0123456789abcdef"), 4)
+    audio = append(audio, "tail"...)
+
+    // Metadata after every 16 bytes of audio, with the title changing partway through and an empty block in between
+    var body []byte
+    body = append(body, audio[0:16]...)
+    body = append(body, icy_block("StreamTitle='First Song';StreamUrl='';")...)
+    body = append(body, audio[16:32]...)
+    body = append(body, 0)
+    body = append(body, audio[32:48]...)
+    body = append(body, icy_block("StreamTitle='First Song';")...)
+    body = append(body, audio[48:64]...)
+    body = append(body, icy_block("StreamTitle='Second Song';")...)
+    body = append(body, audio[64:]...)
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Icy-MetaData") != "1" {
+            t.Errorf("metadata was not asked for")
+        }
+        w.Header().Set("Content-Type", "audio/mpeg")
+        w.Header().Set("icy-name", "Test FM")
+        w.Header().Set("icy-metaint", "16")
+        w.Write(body)
+    }))
+    defer server.Close()
+
+    var titles []string
+    track, err := get_stream_track(server.URL+"/stream", "tester", func(title string) {
+        titles = append(titles, title)
+    })
+    if err != nil {
+        t.Fatalf("get_stream_track: %v", err)
+    }
+    if track.title != "Test FM" || !track.live {
+        t.Fatalf("got track %+v", track)
+    }
+
+    // Small reads make sure nothing goes wrong when a read stops right before a metadata block
+    stream, err := track.source.open()
+    if err != nil {
+        t.Fatalf("open: %v", err)
+    }
+    defer stream.Close()
+    var got []byte
+    buf := make([]byte, 7)
+    for {
+        n, err := stream.Read(buf)
+        got = append(got, buf[:n]...)
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            t.Fatalf("read: %v", err)
+        }
+    }
+
+    if !bytes.Equal(got, audio) {
+        t.Fatalf("got audio %q, expected %q", got, audio)
+    }
+    if strings.Join(titles, "|") != "First Song|Second Song" {
+        t.Fatalf("got titles %q", titles)
+    }
+}
+
+
+func TestStreamHLS(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+        w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\nsegment0.ts\n"))
+    }))
+    defer server.Close()
+
+    // A playlist is not audio itself, but is still accepted since ffmpeg fetches the segments
+    track, err := get_stream_track(server.URL+"/live", "tester", nil)
+    if err != nil {
+        t.Fatalf("get_stream_track: %v", err)
+    }
+    if track.title != server.URL+"/live" {
+        t.Fatalf("got title %q, expected the link", track.title)
+    }
+
+    if !is_hls("http://example.com/live/index.m3u8?token=1", "text/plain") {
+        t.Fatalf("an .m3u8 link was not treated as HLS")
+    }
+    if is_hls("http://example.com/stream.mp3", "audio/mpeg") {
+        t.Fatalf("an mp3 stream was treated as HLS")
+    }
+}
+
+
+func TestStreamNotAudio(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.Write([]byte("<html></html>"))
+    }))
+    defer server.Close()
+
+    if _, err := get_stream_track(server.URL, "tester", nil); err == nil {
+        t.Fatalf("a web page was accepted as a stream")
+    }
+}
+
+
+func TestStreamCutShort(t *testing.T) {
+    // Promises more than it sends, cutting the connection partway through a metadata block
+    var body []byte
+    body = append(body, bytes.Repeat([]byte("a"), 16)...)
+    body = append(body, 2)
+    body = append(body, "StreamTi"...)
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "audio/mpeg")
+        w.Header().Set("icy-metaint", "16")
+        w.Header().Set("Content-Length", "1000")
+        w.WriteHeader(http.StatusOK)
+        w.Write(body)
+        w.(http.Flusher).Flush()
+
+        conn, _, err := w.(http.Hijacker).Hijack()
+        if err == nil {
+            conn.Close()
+        }
+    }))
+    defer server.Close()
+
+    source := &stream_source{url: server.URL}
+    stream, err := source.open()
+    if err != nil {
+        t.Fatalf("open: %v", err)
+    }
+    defer stream.Close()
+
+    got, err := io.ReadAll(stream)
+    if err == nil {
+        t.Fatalf("a cut connection ended cleanly with %v", err)
+    }
+    if !bytes.Equal(got, body[:16]) {
+        t.Fatalf("got %q before the cut, expected the audio", got)
+    }
+
+    // A connection that drops before answering fails straight away
+    dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, _, err := w.(http.Hijacker).Hijack()
+        if err == nil {
+            conn.Close()
+        }
+    }))
+    defer dead.Close()
+    if _, err := get_stream_track(dead.URL, "tester", nil); err == nil {
+        t.Fatalf("a dropped connection was accepted")
+    }
+}
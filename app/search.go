@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+    // Plain digits, as ParseFloat and Atoi also take signs, exponents, "inf" and "nan"
+    timestamp_part_regex = regexp.MustCompile(`^[0-9]+$`)
+    timestamp_secs_regex = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+)
+
+type SearchResult struct {
+    id string
+    title string
+    channel string
+    duration time.Duration
+}
+
+// Anything that can turn a text query into a list of youtube videos
+// Swapped out for a local fake when testing so nothing needs to talk to youtube
+type Searcher interface {
+    search(query string, limit int) ([]SearchResult, error)
+}
+
+type youtube_searcher struct {
+    http_client *http.Client
+}
+
+// A +search that is waiting for its author to pick one of the listed results
+type PendingSearch struct {
+    results []SearchResult
+    timer *time.Timer
+}
+
+var (
+    searcher Searcher = &youtube_searcher{http_client: &http.Client{Timeout: 10 * time.Second}}
+
+    // Keyed by channel ID and user ID, so each user can have one pending search per channel
+    pending_searches = map[string]*PendingSearch{}
+    pending_mutx sync.Mutex
+)
+
+const (
+    yt_innertube_url string = "https://www.youtube.com/youtubei/v1/"
+    yt_web_client_version string = "2.20240726.00.00"
+    // Protobuf encoded search filter that limits results to videos only (no channels, playlists, etc.)
+    yt_search_videos_only string = "EgIQAQ=="
+
+    search_result_count int = 8
+    search_pick_timeout time.Duration = 30 * time.Second
+)
+
+
+func pending_key(channel_id string, user_id string) string {
+    return channel_id + ":" + user_id
+}
+
+
+func search_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
+    query := cmd_argument(m.Content)
+
+    // Make sure there is something to search for
+    if query == "" {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid syntax: use `%csearch [text]`", settings.cmd_prefix))
+        return
+    }
+
+    results, err := searcher.search(query, search_result_count)
+    if err != nil {
+        s.ChannelMessageSend(m.ChannelID, "Unable to search youtube right now, please try again")
+        log.Printf("searching: %s\n", err.Error())
+        return
+    }
+    if len(results) == 0 {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("No results found for '%s'", query))
+        return
+    }
+
+    // List the results so the user can pick one
+    list := fmt.Sprintf("Results for '%s':", query)
+    for i, r := range results {
+        list += fmt.Sprintf("\n`%d.` %s - %s [%v]", i+1, r.title, r.channel, r.duration)
+    }
+    list += fmt.Sprintf("\nReply with a number to play it, or `cancel`. This expires in %v", search_pick_timeout)
+
+    key := pending_key(m.ChannelID, m.Author.ID)
+    pending := &PendingSearch{results: results}
+
+    pending_mutx.Lock()
+    // A newer search from the same user replaces the old one
+    if old, exists := pending_searches[key]; exists {
+        old.timer.Stop()
+    }
+    pending.timer = time.AfterFunc(search_pick_timeout, func() {
+        pending_mutx.Lock()
+        // Only cancel if this search has not already been picked or replaced
+        if pending_searches[key] != pending {
+            pending_mutx.Unlock()
+            return
+        }
+        delete(pending_searches, key)
+        pending_mutx.Unlock()
+
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("<@%s> search selection timed out", m.Author.ID))
+    })
+    pending_searches[key] = pending
+    pending_mutx.Unlock()
+
+    s.ChannelMessageSend(m.ChannelID, list)
+}
+
+
+// Checks if a message is the answer to a pending search, and if it is, enqueues the picked result
+// Returns true if the message was consumed as a pick
+func handle_search_pick(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+    key := pending_key(m.ChannelID, m.Author.ID)
+    answer := strings.ToLower(strings.TrimSpace(m.Content))
+
+    pending_mutx.Lock()
+    pending, exists := pending_searches[key]
+    if !exists {
+        pending_mutx.Unlock()
+        return false
+    }
+
+    if answer == "cancel" {
+        pending.timer.Stop()
+        delete(pending_searches, key)
+        pending_mutx.Unlock()
+        s.ChannelMessageSend(m.ChannelID, "Search cancelled")
+        return true
+    }
+
+    // Anything that is not a number is treated as a normal message
+    pick, err := strconv.Atoi(answer)
+    if err != nil {
+        pending_mutx.Unlock()
+        return false
+    }
+    if pick < 1 || pick > len(pending.results) {
+        pending_mutx.Unlock()
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Pick a number between 1 and %d", len(pending.results)))
+        return true
+    }
+
+    pending.timer.Stop()
+    delete(pending_searches, key)
+    pending_mutx.Unlock()
+
+    result := pending.results[pick-1]
+    vid, err := get_video_by_id(result.id)
+    if err != nil {
+        s.ChannelMessageSend(m.ChannelID, youtube_error_message(err, "video"))
+        log.Printf("failed to get picked video: %s\n", err.Error())
+        return true
+    }
+    log.Printf("picked youtube video: [%s] - [%s]\n", vid.Title, vid.ID)
+
+    enqueue_track(s, m, track_from_video(vid, m.Author.Username))
+    return true
+}
+
+
+// Subset of the innertube responses that is needed to build search results
+type yt_search_text struct {
+    SimpleText string `json:"simpleText"`
+    Runs []struct {
+        Text string `json:"text"`
+    } `json:"runs"`
+}
+
+func (t yt_search_text) String() string {
+    if t.SimpleText != "" {
+        return t.SimpleText
+    }
+    var out string
+    for _, r := range t.Runs {
+        out += r.Text
+    }
+    return out
+}
+
+type yt_search_response struct {
+    Contents struct {
+        TwoColumnSearchResultsRenderer struct {
+            PrimaryContents struct {
+                SectionListRenderer struct {
+                    Contents []struct {
+                        ItemSectionRenderer struct {
+                            Contents []struct {
+                                VideoRenderer *struct {
+                                    VideoID string `json:"videoId"`
+                                    Title yt_search_text `json:"title"`
+                                    OwnerText yt_search_text `json:"ownerText"`
+                                    LengthText yt_search_text `json:"lengthText"`
+                                } `json:"videoRenderer"`
+                            } `json:"contents"`
+                        } `json:"itemSectionRenderer"`
+                    } `json:"contents"`
+                } `json:"sectionListRenderer"`
+            } `json:"primaryContents"`
+        } `json:"twoColumnSearchResultsRenderer"`
+    } `json:"contents"`
+}
+
+
+// Sends a request to one of youtube's internal (innertube) API endpoints as if it were the youtube website
+func innertube_post(http_client *http.Client, endpoint string, payload map[string]any, out any) error {
+    payload["context"] = map[string]any{
+        "client": map[string]any{
+            "clientName": "WEB",
+            "clientVersion": yt_web_client_version,
+            "hl": "en",
+            "gl": "US",
+        },
+    }
+
+    body, err := json.Marshal(payload)
+    if err != nil {
+        return fmt.Errorf("building request: %s", err.Error())
+    }
+
+    resp, err := http_client.Post(yt_innertube_url+endpoint+"?prettyPrint=false", "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("unexpected status %d", resp.StatusCode)
+    }
+
+    err = json.NewDecoder(resp.Body).Decode(out)
+    if err != nil {
+        return fmt.Errorf("decoding response: %s", err.Error())
+    }
+
+    return nil
+}
+
+
+func (y *youtube_searcher) search(query string, limit int) ([]SearchResult, error) {
+    var data yt_search_response
+    err := innertube_post(y.http_client, "search", map[string]any{
+        "query": query,
+        "params": yt_search_videos_only,
+    }, &data)
+    if err != nil {
+        return nil, fmt.Errorf("searching youtube: %s", err.Error())
+    }
+
+    // Walk every section of the results page, keeping only actual videos
+    results := []SearchResult{}
+    for _, section := range data.Contents.TwoColumnSearchResultsRenderer.PrimaryContents.SectionListRenderer.Contents {
+        for _, item := range section.ItemSectionRenderer.Contents {
+            vr := item.VideoRenderer
+            if vr == nil || vr.VideoID == "" {
+                continue
+            }
+
+            // Live streams have no length, so the duration is left at 0 for those
+            dur, _ := parse_timestamp(vr.LengthText.String())
+
+            results = append(results, SearchResult{
+                id: vr.VideoID,
+                title: vr.Title.String(),
+                channel: vr.OwnerText.String(),
+                duration: dur,
+            })
+            if len(results) >= limit {
+                return results, nil
+            }
+        }
+    }
+
+    return results, nil
+}
+
+
+// Parses timestamps in the form of "SS", "M:SS" or "H:MM:SS" into a duration
+func parse_timestamp(ts string) (time.Duration, error) {
+    ts = strings.TrimSpace(ts)
+    if ts == "" {
+        return 0, fmt.Errorf("empty timestamp")
+    }
+
+    parts := strings.Split(ts, ":")
+    if len(parts) > 3 {
+        return 0, fmt.Errorf("invalid timestamp '%s'", ts)
+    }
+
+    var total float64
+    for i, p := range parts {
+        // Only the last section (seconds) may have a fractional part
+        if i == len(parts)-1 {
+            if !timestamp_secs_regex.MatchString(p) {
+                return 0, fmt.Errorf("invalid timestamp '%s'", ts)
+            }
+            secs, err := strconv.ParseFloat(p, 64)
+            if err != nil || secs < 0 || (len(parts) > 1 && secs >= 60) {
+                return 0, fmt.Errorf("invalid timestamp '%s'", ts)
+            }
+            total = total*60 + secs
+            break
+        }
+
+        if !timestamp_part_regex.MatchString(p) {
+            return 0, fmt.Errorf("invalid timestamp '%s'", ts)
+        }
+        n, err := strconv.Atoi(p)
+        if err != nil || (i > 0 && n >= 60) {
+            return 0, fmt.Errorf("invalid timestamp '%s'", ts)
+        }
+        total = total*60 + float64(n)
+    }
+
+    return time.Duration(total * float64(time.Second)), nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Answers searches from a fixed list, remembering what it was asked
+type fake_searcher struct {
+    results []SearchResult
+    err error
+    queries []string
+    limits []int
+}
+
+// Sends every request to a local server, whatever host it was meant for
+type redirect_transport struct {
+    target *url.URL
+}
+
+
+func (f *fake_searcher) search(query string, limit int) ([]SearchResult, error) {
+    f.queries = append(f.queries, query)
+    f.limits = append(f.limits, limit)
+    if f.err != nil {
+        return nil, f.err
+    }
+    if len(f.results) > limit {
+        return f.results[:limit], nil
+    }
+    return f.results, nil
+}
+
+
+func (r redirect_transport) RoundTrip(req *http.Request) (*http.Response, error) {
+    req = req.Clone(req.Context())
+    req.URL.Scheme = r.target.Scheme
+    req.URL.Host = r.target.Host
+    return http.DefaultTransport.RoundTrip(req)
+}
+
+
+// Replaces the searcher for one test
+func use_searcher(t *testing.T, s Searcher) {
+    old := searcher
+    searcher = s
+    t.Cleanup(func() {
+        searcher = old
+    })
+}
+
+
+func TestVideoIDSearchFallback(t *testing.T) {
+    fake := &fake_searcher{results: []SearchResult{{id: "first"}, {id: "second"}}}
+    use_searcher(t, fake)
+
+    // Text is searched for, taking the top result
+    id, err := video_id("daft punk around the world")
+    if err != nil || id != "first" {
+        t.Fatalf("got %q, %v", id, err)
+    }
+    if len(fake.queries) != 1 || fake.queries[0] != "daft punk around the world" || fake.limits[0] != 1 {
+        t.Fatalf("searched %v with limits %v", fake.queries, fake.limits)
+    }
+
+    // Links go straight to the video without searching
+    id, err = video_id("https://www.youtube.com/watch?v=dQw4w9WgXcQ")
+    if err != nil || id != "dQw4w9WgXcQ" {
+        t.Fatalf("got %q, %v", id, err)
+    }
+    if len(fake.queries) != 1 {
+        t.Fatalf("a link was searched for")
+    }
+}
+
+
+func TestVideoIDSearchErrors(t *testing.T) {
+    use_searcher(t, &fake_searcher{})
+    _, err := video_id("nothing matches this")
+    var yt_err *YoutubeError
+    if !errors.As(err, &yt_err) || yt_err.kind != yt_err_not_found {
+        t.Fatalf("no results gave %v, expected not found", err)
+    }
+
+    use_searcher(t, &fake_searcher{err: errors.New("connection refused")})
+    _, err = video_id("anything")
+    if !errors.As(err, &yt_err) || yt_err.kind != yt_err_network {
+        t.Fatalf("a failed search gave %v, expected a network error", err)
+    }
+}
+
+
+func TestInnertubeSearch(t *testing.T) {
+    // Trimmed down from a real response, with a channel and a live stream mixed in among the videos
+    response := `{"contents":{"twoColumnSearchResultsRenderer":{"primaryContents":{"sectionListRenderer":{"contents":[
+        {"itemSectionRenderer":{"contents":[
+            {"channelRenderer":{"channelId":"UC123"}},
+            {"videoRenderer":{"videoId":"aaa","title":{"runs":[{"text":"Around "},{"text":"the World"}]},"ownerText":{"runs":[{"text":"Daft Punk"}]},"lengthText":{"simpleText":"7:09"}}},
+            {"videoRenderer":{"videoId":"bbb","title":{"simpleText":"Live Radio"},"ownerText":{"simpleText":"Some Station"}}}
+        ]}},
+        {"continuationItemRenderer":{}},
+        {"itemSectionRenderer":{"contents":[
+            {"videoRenderer":{"videoId":"ccc","title":{"simpleText":"Long Mix"},"ownerText":{"simpleText":"DJ"},"lengthText":{"simpleText":"1:02:03"}}}
+        ]}}
+    ]}}}}}`
+
+    var body map[string]any
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/youtubei/v1/search" {
+            t.Errorf("request to %s", r.URL.Path)
+        }
+        data, _ := io.ReadAll(r.Body)
+        json.Unmarshal(data, &body)
+        w.Write([]byte(response))
+    }))
+    defer server.Close()
+
+    target, _ := url.Parse(server.URL)
+    y := &youtube_searcher{http_client: &http.Client{Transport: redirect_transport{target: target}}}
+
+    results, err := y.search("daft punk", 10)
+    if err != nil {
+        t.Fatalf("search: %v", err)
+    }
+    if body["query"] != "daft punk" || body["params"] != yt_search_videos_only {
+        t.Fatalf("sent %v", body)
+    }
+
+    expected := []SearchResult{
+        {id: "aaa", title: "Around the World", channel: "Daft Punk", duration: 7*time.Minute + 9*time.Second},
+        {id: "bbb", title: "Live Radio", channel: "Some Station"},
+        {id: "ccc", title: "Long Mix", channel: "DJ", duration: time.Hour + 2*time.Minute + 3*time.Second},
+    }
+    if len(results) != len(expected) {
+        t.Fatalf("got %d results, expected %d", len(results), len(expected))
+    }
+    for i := range expected {
+        if results[i] != expected[i] {
+            t.Fatalf("result %d was %+v, expected %+v", i, results[i], expected[i])
+        }
+    }
+
+    // The limit cuts the results short
+    results, err = y.search("daft punk", 2)
+    if err != nil || len(results) != 2 {
+        t.Fatalf("limited search gave %d results, %v", len(results), err)
+    }
+}
+
+
+func TestInnertubeSearchBadStatus(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusTooManyRequests)
+    }))
+    defer server.Close()
+
+    target, _ := url.Parse(server.URL)
+    y := &youtube_searcher{http_client: &http.Client{Transport: redirect_transport{target: target}}}
+    if _, err := y.search("anything", 1); err == nil {
+        t.Fatalf("a 429 did not fail")
+    }
+}
+
+
+func TestParseTimestamp(t *testing.T) {
+    valid := map[string]time.Duration{
+        "1:02:03": time.Hour + 2*time.Minute + 3*time.Second,
+        "3:07": 3*time.Minute + 7*time.Second,
+        "45": 45 * time.Second,
+        "0:30.5": 30*time.Second + 500*time.Millisecond,
+        " 3:07 ": 3*time.Minute + 7*time.Second,
+    }
+    for ts, expected := range valid {
+        d, err := parse_timestamp(ts)
+        if err != nil || d != expected {
+            t.Errorf("%q gave %s, %v, expected %s", ts, d, err, expected)
+        }
+    }
+
+    invalid := []string{"", "   ", "abc", "1:2:3:4", "3:60", "1:60:00", "-5", "1:-5", "1::30", "3:07:", "1.5:30",
+        // Only plain digits, not everything ParseFloat understands
+        "nan", "NaN", "inf", "1:inf", "1e3", "0x10", "+5", "1:+5", "3:07.", ".5"}
+    for _, ts := range invalid {
+        if d, err := parse_timestamp(ts); err == nil {
+            t.Errorf("%q gave %s, expected an error", ts, d)
+        }
+    }
+}
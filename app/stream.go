@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// Reads a youtube stream in ranged chunks, picking up where it left off if the connection drops
+// A dropped connection would otherwise look like a normal end of file, and the song would stop early
+type resilient_stream struct {
+    video *youtube.Video
+    format *youtube.Format
+    url string
+
+    // Total size of the stream, 0 until it is known
+    length int64
+    // Bytes handed to the caller so far, which is where the next request starts
+    offset int64
+    // Offset the current response should end at
+    chunk_end int64
+
+    // Failures since the last successful read
+    retries int
+
+    // Guards body and closed, so Close can be called from another thread
+    mutx sync.Mutex
+    body io.ReadCloser
+    closed bool
+}
+
+var (
+    stream_retry_client = &http.Client{
+        Transport: &http.Transport{
+            Proxy: http.ProxyFromEnvironment,
+            ResponseHeaderTimeout: 10 * time.Second,
+        },
+    }
+
+    // Youtube lookups for opening and refreshing a stream, tests swap these out so they do not need youtube
+    stream_video_lookup = get_video_by_id
+    stream_url_lookup = youtube_stream_url
+)
+
+const (
+    // Youtube throttles requests for large ranges, so ask for the stream a piece at a time
+    stream_chunk_size int64 = 10 * 1024 * 1024
+    stream_max_retries int = 5
+    stream_retry_delay time.Duration = 500 * time.Millisecond
+)
+
+
+func new_resilient_stream(video *youtube.Video, format *youtube.Format) (*resilient_stream, error) {
+    r := &resilient_stream{
+        video: video,
+        format: format,
+        length: format.ContentLength,
+    }
+
+    // Fail straight away if the stream can not be opened at all, rather than on the first read
+    err := r.resolve_url()
+    if err != nil {
+        return nil, err
+    }
+    err = r.request()
+    if err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+
+func youtube_stream_url(video *youtube.Video, format *youtube.Format) (string, error) {
+    client := youtube.Client{}
+    return client.GetStreamURL(video, format)
+}
+
+
+func (r *resilient_stream) resolve_url() error {
+    url, err := stream_url_lookup(r.video, r.format)
+    if err != nil {
+        return err
+    }
+    r.url = url
+    return nil
+}
+
+
+// Stream URLs expire after a few hours, so long queues need to fetch a fresh one
+func (r *resilient_stream) refresh_url() error {
+    video, err := stream_video_lookup(r.video.ID)
+    if err != nil {
+        return err
+    }
+
+    // Stick to the same format so the bytes already read still line up
+    formats := video.Formats.Itag(r.format.ItagNo)
+    if len(formats) == 0 {
+        return fmt.Errorf("itag %d is no longer available", r.format.ItagNo)
+    }
+    r.video = video
+    r.format = &formats[0]
+    return r.resolve_url()
+}
+
+
+// Input options for ffmpeg to open the stream itself, which lets it seek using ranged requests of its own
+// It can not resume like this reader does, so its own reconnect options are used instead
+func (r *resilient_stream) ffmpeg_input() []string {
+    return []string{
+        "-headers", "Origin: https://youtube.com\r\n",
+        "-reconnect", "1",
+        "-reconnect_delay_max", "5",
+        "-i", r.url,
+    }
+}
+
+
+// Requests the next chunk of the stream starting from the current offset
+func (r *resilient_stream) request() error {
+    end := r.offset + stream_chunk_size - 1
+    if r.length > 0 && end >= r.length {
+        end = r.length - 1
+    }
+
+    req, err := http.NewRequest(http.MethodGet, r.url, nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, end))
+    req.Header.Set("Origin", "https://youtube.com")
+
+    resp, err := stream_retry_client.Do(req)
+    if err != nil {
+        return err
+    }
+
+    switch resp.StatusCode {
+    case http.StatusPartialContent:
+        // Content-Range looks like "bytes 0-1023/4096", the part after the slash is the total size
+        _, total, found := strings.Cut(resp.Header.Get("Content-Range"), "/")
+        if n, err := strconv.ParseInt(total, 10, 64); found && err == nil {
+            r.length = n
+        }
+        r.chunk_end = r.offset + resp.ContentLength
+    case http.StatusOK:
+        // The server ignored the range, which is only usable from the very start
+        if r.offset != 0 {
+            resp.Body.Close()
+            return fmt.Errorf("server does not support resuming")
+        }
+        r.length = resp.ContentLength
+        r.chunk_end = resp.ContentLength
+    default:
+        resp.Body.Close()
+        return youtube.ErrUnexpectedStatusCode(resp.StatusCode)
+    }
+
+    r.mutx.Lock()
+    defer r.mutx.Unlock()
+    if r.closed {
+        resp.Body.Close()
+        return fmt.Errorf("stream closed")
+    }
+    r.body = resp.Body
+    return nil
+}
+
+
+func (r *resilient_stream) Read(p []byte) (int, error) {
+    for {
+        if r.length > 0 && r.offset >= r.length {
+            return 0, io.EOF
+        }
+
+        body, err := r.current_body()
+        if err != nil {
+            return 0, err
+        }
+        if body == nil {
+            err := r.request()
+            if err == nil {
+                continue
+            }
+            err = r.retry(err)
+            if err != nil {
+                return 0, err
+            }
+            continue
+        }
+
+        n, err := body.Read(p)
+        r.offset += int64(n)
+        if n > 0 {
+            r.retries = 0
+        }
+        if err == nil {
+            return n, nil
+        }
+        r.drop_body()
+
+        if err == io.EOF && r.offset >= r.chunk_end {
+            // Without a length there is no way to tell a finished stream from a cut off one
+            if r.length <= 0 || r.offset >= r.length {
+                return n, io.EOF
+            }
+            // Otherwise this was just the end of a chunk, the next read requests the next one
+            if n > 0 {
+                return n, nil
+            }
+            continue
+        }
+
+        // Anything else means the transfer was cut short
+        if err == io.EOF {
+            err = fmt.Errorf("transfer ended at byte %d, expected %d", r.offset, r.chunk_end)
+        }
+        retry_err := r.retry(err)
+        if retry_err != nil {
+            return n, retry_err
+        }
+        if n > 0 {
+            return n, nil
+        }
+    }
+}
+
+
+func (r *resilient_stream) current_body() (io.ReadCloser, error) {
+    r.mutx.Lock()
+    defer r.mutx.Unlock()
+    if r.closed {
+        return nil, fmt.Errorf("read on closed stream")
+    }
+    return r.body, nil
+}
+
+
+func (r *resilient_stream) drop_body() {
+    r.mutx.Lock()
+    defer r.mutx.Unlock()
+    if r.body != nil {
+        r.body.Close()
+        r.body = nil
+    }
+}
+
+
+// Waits before the next attempt, giving up after too many failures in a row
+func (r *resilient_stream) retry(cause error) error {
+    r.retries++
+    if r.retries > stream_max_retries {
+        log.Printf("stream [%s]: giving up at byte %d after %d retries: %s\n", r.video.ID, r.offset, stream_max_retries, cause.Error())
+        return fmt.Errorf("stream failed after %d retries: %s", stream_max_retries, cause.Error())
+    }
+    log.Printf("stream [%s]: resuming from byte %d (attempt %d/%d): %s\n", r.video.ID, r.offset, r.retries, stream_max_retries, cause.Error())
+
+    time.Sleep(stream_retry_delay * time.Duration(r.retries))
+
+    // A forbidden response usually means the URL expired
+    if code, ok := cause.(youtube.ErrUnexpectedStatusCode); ok && (code == http.StatusForbidden || code == http.StatusGone) {
+        err := r.refresh_url()
+        if err != nil {
+            log.Printf("stream [%s]: unable to refresh url: %s\n", r.video.ID, err.Error())
+        }
+    }
+    return nil
+}
+
+
+// Can be called while another thread is blocked in Read, which unblocks it
+func (r *resilient_stream) Close() error {
+    r.mutx.Lock()
+    defer r.mutx.Unlock()
+    r.closed = true
+    if r.body != nil {
+        err := r.body.Close()
+        r.body = nil
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// Serves a stream in ranges, with the first response cut off partway through
+type flaky_stream_server struct {
+    data []byte
+    // How many bytes the first response sends before the connection drops
+    cut_at int
+    // Whether the first URL stops working after the first request, as an expired youtube URL does
+    expire bool
+
+    mutx sync.Mutex
+    requests []string
+}
+
+
+func (f *flaky_stream_server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    f.mutx.Lock()
+    f.requests = append(f.requests, r.URL.Path+" "+r.Header.Get("Range"))
+    first := len(f.requests) == 1
+    f.mutx.Unlock()
+
+    if r.URL.Path == "/old" && f.expire && !first {
+        w.WriteHeader(http.StatusForbidden)
+        return
+    }
+
+    var start, end int
+    if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || end >= len(f.data) {
+        w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+        return
+    }
+    w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(f.data)))
+    w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+    w.WriteHeader(http.StatusPartialContent)
+
+    if !first {
+        w.Write(f.data[start : end+1])
+        return
+    }
+
+    // Drop the connection in the middle of the chunk
+    w.Write(f.data[start:f.cut_at])
+    w.(http.Flusher).Flush()
+    conn, _, err := w.(http.Hijacker).Hijack()
+    if err == nil {
+        conn.Close()
+    }
+}
+
+
+func (f *flaky_stream_server) request_log() []string {
+    f.mutx.Lock()
+    defer f.mutx.Unlock()
+    return append([]string{}, f.requests...)
+}
+
+
+// Opens a resilient stream against a local server, with youtube lookups answered from the given URLs
+func open_test_stream(t *testing.T, f *flaky_stream_server, old_url string, new_url string) *resilient_stream {
+    t.Helper()
+    format := youtube.Format{ItagNo: 251, ContentLength: int64(len(f.data))}
+    video := &youtube.Video{ID: "test", Formats: youtube.FormatList{format}}
+
+    old_video_lookup, old_url_lookup := stream_video_lookup, stream_url_lookup
+    stream_video_lookup = func(id string) (*youtube.Video, error) {
+        // A fresh copy, with the same format under a new URL
+        return &youtube.Video{ID: id, Formats: youtube.FormatList{format}}, nil
+    }
+    stream_url_lookup = func(v *youtube.Video, fm *youtube.Format) (string, error) {
+        if v == video {
+            return old_url, nil
+        }
+        return new_url, nil
+    }
+    t.Cleanup(func() {
+        stream_video_lookup, stream_url_lookup = old_video_lookup, old_url_lookup
+    })
+
+    r, err := new_resilient_stream(video, &video.Formats[0])
+    if err != nil {
+        t.Fatalf("open: %v", err)
+    }
+    t.Cleanup(func() {
+        r.Close()
+    })
+    return r
+}
+
+
+func test_stream_data() []byte {
+    data := make([]byte, 100000)
+    for i := range data {
+        data[i] = byte(i * 7)
+    }
+    return data
+}
+
+
+func TestResilientStreamResumes(t *testing.T) {
+    f := &flaky_stream_server{data: test_stream_data(), cut_at: 30000}
+    server := httptest.NewServer(f)
+    defer server.Close()
+
+    r := open_test_stream(t, f, server.URL+"/old", server.URL+"/new")
+    got, err := io.ReadAll(r)
+    if err != nil {
+        t.Fatalf("read: %v", err)
+    }
+    if !bytes.Equal(got, f.data) {
+        t.Fatalf("got %d bytes that do not match the %d sent", len(got), len(f.data))
+    }
+
+    // The second request carries on from exactly where the first was cut off
+    expected := []string{"/old bytes=0-99999", "/old bytes=30000-99999"}
+    requests := f.request_log()
+    if fmt.Sprint(requests) != fmt.Sprint(expected) {
+        t.Fatalf("requests were %q, expected %q", requests, expected)
+    }
+}
+
+
+func TestResilientStreamRefreshesURL(t *testing.T) {
+    f := &flaky_stream_server{data: test_stream_data(), cut_at: 12345, expire: true}
+    server := httptest.NewServer(f)
+    defer server.Close()
+
+    r := open_test_stream(t, f, server.URL+"/old", server.URL+"/new")
+    got, err := io.ReadAll(r)
+    if err != nil {
+        t.Fatalf("read: %v", err)
+    }
+    if !bytes.Equal(got, f.data) {
+        t.Fatalf("got %d bytes that do not match the %d sent", len(got), len(f.data))
+    }
+
+    // The expired URL is refused, then a fresh one picks up from the same byte
+    expected := []string{"/old bytes=0-99999", "/old bytes=12345-99999", "/new bytes=12345-99999"}
+    requests := f.request_log()
+    if fmt.Sprint(requests) != fmt.Sprint(expected) {
+        t.Fatalf("requests were %q, expected %q", requests, expected)
+    }
+}
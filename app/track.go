@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// Anything that can provide the raw audio for a track, e.g. youtube, a local file, a radio stream
+type Source interface {
+    // Opens a new reader for the encoded audio data, which ffmpeg will turn into PCM
+    open() (io.ReadCloser, error)
+}
+
+// Anything that provides ready to send Opus packets, e.g. a WebM demuxer
+type OpusReader interface {
+    // Returns the next packet, or io.EOF once there are none left
+    read_packet() ([]byte, error)
+    Close() error
+}
+
+// Sources that can sometimes provide Opus packets directly implement this, letting playback skip ffmpeg and gopus
+// A nil reader means this track has to be transcoded instead
+type opus_source interface {
+    open_opus() (OpusReader, error)
+}
+
+// Sources that have to fetch more before they can be opened implement this, e.g. videos queued from a playlist
+// The source is not changed, as other goroutines may be reading it, the run goroutine puts the returned one on the track instead
+type resolvable interface {
+    resolve() (Source, error)
+}
+
+// Sources holding resources of their own (e.g. temporary files) implement this to free them once the track leaves the queue
+type releasable interface {
+    release()
+}
+
+// One entry in a call's queue, independent of where the audio comes from
+type Track struct {
+    // Stable identifier made of the source type and the ID within that source, e.g. "yt:dQw4w9WgXcQ"
+    id string
+    title string
+    // Zero when the length is unknown, e.g. for live streams
+    duration time.Duration
+    // Live tracks (e.g. radio) never end on their own
+    live bool
+    // Display name of the user who queued the track
+    requester string
+    source Source
+    // Where playback begins, set from a t= link or moved by a seek
+    start time.Duration
+}
+
+type youtube_source struct {
+    video *youtube.Video
+}
+
+
+func (y *youtube_source) resolve() (Source, error) {
+    video, err := resolve_formats(y.video)
+    if err != nil {
+        return nil, err
+    }
+    if video == y.video {
+        return y, nil
+    }
+    return &youtube_source{video: video}, nil
+}
+
+
+func (y *youtube_source) open() (io.ReadCloser, error) {
+    stream, _, err := get_audio_stream(y.video)
+    return stream, err
+}
+
+
+// Youtube's Opus formats are WebM at 48 kHz, which is exactly what discord wants, so they can be sent as is
+func (y *youtube_source) open_opus() (OpusReader, error) {
+    video, err := resolve_formats(y.video)
+    if err != nil {
+        return nil, err
+    }
+
+    format, err := select_audio_format(video)
+    if err != nil {
+        return nil, err
+    }
+    if format_codec(format) != "opus" || format_extension(format) != "webm" || format.AudioSampleRate != "48000" || format.AudioChannels > audio_chan {
+        return nil, nil
+    }
+
+    stream, err := open_format(video, format)
+    if err != nil {
+        return nil, err
+    }
+    return new_webm_reader(stream), nil
+}
+
+
+func (t *Track) duration_string() string {
+    if t.live {
+        return "live"
+    }
+    return t.duration.String()
+}
+
+
+// Returns a copy of the track with a source that is ready to open, or the track itself if nothing needed fetching
+func resolve_track(t *Track) (*Track, error) {
+    r, ok := t.source.(resolvable)
+    if !ok {
+        return t, nil
+    }
+    source, err := r.resolve()
+    if err != nil {
+        return nil, err
+    }
+    resolved := *t
+    resolved.source = source
+    return &resolved, nil
+}
+
+
+func release_track(t *Track) {
+    if r, ok := t.source.(releasable); ok {
+        r.release()
+    }
+}
+
+
+func release_tracks(tracks []*Track) {
+    for _, t := range tracks {
+        release_track(t)
+    }
+}
+
+
+func track_from_video(video *youtube.Video, requester string) *Track {
+    return &Track{
+        id: "yt:" + video.ID,
+        title: video.Title,
+        duration: video.Duration,
+        requester: requester,
+        source: &youtube_source{video: video},
+    }
+}
+
+
+func tracks_from_videos(videos []*youtube.Video, requester string) []*Track {
+    tracks := make([]*Track, 0, len(videos))
+    for _, video := range videos {
+        tracks = append(tracks, track_from_video(video, requester))
+    }
+    return tracks
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+    max_crossfade time.Duration = 12 * time.Second
+)
+
+
+func crossfade_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
+    argument := strings.ToLower(cmd_argument(m.Content))
+
+    // Without an argument, just show the current setting
+    if argument == "" {
+        crossfade := get_guild_settings(m.GuildID).crossfade
+        if crossfade == 0 {
+            s.ChannelMessageSend(m.ChannelID, "Crossfade is off")
+        } else {
+            s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Crossfade is %s", crossfade))
+        }
+        return
+    }
+
+    var crossfade time.Duration
+    if argument != "off" {
+        secs, err := strconv.ParseFloat(strings.TrimSuffix(argument, "s"), 64)
+        // NaN passes both comparisons, so it has to be turned down on its own
+        if err != nil || math.IsNaN(secs) || secs < 0 || secs > max_crossfade.Seconds() {
+            s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid syntax: use `%ccrossfade [seconds up to %g]` or `%ccrossfade off`",
+                settings.cmd_prefix, max_crossfade.Seconds(), settings.cmd_prefix))
+            return
+        }
+        crossfade = time.Duration(secs * float64(time.Second))
+    }
+
+    // Takes effect from the next track change, the tail of the current track is only held back when it starts
+    update_guild_settings(m.GuildID, func(gs *GuildSettings) {
+        gs.crossfade = crossfade
+    })
+    if crossfade == 0 {
+        s.ChannelMessageSend(m.ChannelID, "Crossfade off")
+    } else {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Tracks will crossfade over %s, starting from the next track", crossfade))
+    }
+}
+
+
+func gapless_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
+    argument := strings.ToLower(cmd_argument(m.Content))
+
+    var gapless bool
+    switch argument {
+    case "":
+        if get_guild_settings(m.GuildID).gapless {
+            s.ChannelMessageSend(m.ChannelID, "Gapless playback is on")
+        } else {
+            s.ChannelMessageSend(m.ChannelID, "Gapless playback is off")
+        }
+        return
+    case "on":
+        gapless = true
+    case "off":
+        gapless = false
+    default:
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid syntax: use `%cgapless [on|off]`", settings.cmd_prefix))
+        return
+    }
+
+    update_guild_settings(m.GuildID, func(gs *GuildSettings) {
+        gs.gapless = gapless
+    })
+    if gapless {
+        s.ChannelMessageSend(m.ChannelID, "Gapless playback on")
+    } else {
+        s.ChannelMessageSend(m.ChannelID, "Gapless playback off")
+    }
+}
+
+
+// Whether tracks should run straight into each other, keeping the encoder and speaking state from one to the next
+func (gs GuildSettings) seamless() bool {
+    return gs.gapless || gs.crossfade > 0
+}
+
+
+// Number of frames held back at the end of each track to mix into the next one
+func crossfade_frames(crossfade time.Duration) int {
+    return int(crossfade / audio_frame_duration)
+}
+
+
+// Mixes a frame from the end of the previous track into a frame of the new one
+// step is which frame of the crossfade this is out of steps, the new track fades in as the old one fades out
+func mix_crossfade(pcm []int16, tail []int16, step int, steps int) {
+    frames := len(pcm) / audio_chan
+    for i := 0; i < frames; i++ {
+        // Equal power curves, so the overall loudness does not dip in the middle
+        progress := float64(step*frames+i+1) / float64(steps*frames)
+        in := math.Sin(progress * math.Pi / 2)
+        out := math.Cos(progress * math.Pi / 2)
+        for c := 0; c < audio_chan; c++ {
+            idx := i*audio_chan + c
+            pcm[idx] = clip_sample(float64(pcm[idx])*in + float64(tail[idx])*out)
+        }
+    }
+}
@@ -2,35 +2,86 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
-	"github.com/kkdai/youtube/v2"
 	"layeh.com/gopus"
 )
 
-type Call struct {
+// The parts of a discord voice connection the player uses, so tests can stand in for discord
+type VoiceConn interface {
+    // Opus packets sent here are played in the call, one every 20ms
+    opus_send() chan<- []byte
+    speaking(speaking bool) error
+    // Switches to another voice channel in the same guild, keeping the connection and anything queued to send
+    move(channel_id string) error
+    // Leaves the voice channel and closes the connection
+    disconnect()
+}
+
+type discord_voice struct {
     vc *discordgo.VoiceConnection
-    playing bool
-    should_exit bool
-    paused *bool
+}
+
+// A single playthrough of a track, from when it starts until it ends, is skipped or restarts at a new position
+// The player starts one at a time and hears back on its finished channel once the sending threads have all exited
+type playback struct {
+    guild_id string
+    vc VoiceConn
+    pause *pause_state
+    track *Track
+    // Settings and filter graph the playthrough started with, changing the graph restarts the track
+    gs GuildSettings
+    graph string
+    // Set when the same track is restarting at a new position, so it is not announced again
+    seeking bool
+    // Readied while the previous track played, nil if the track has to be opened from scratch
+    prefetch *Prefetch
+    // Kept from the previous track for gapless playback, made here if nil
+    opus_enc *gopus.Encoder
+    // The end of the previous track, to be mixed into the start of this one
+    fade_in [][]int16
+
     bts_ctx context.Context
     bts_cancel context.CancelFunc
     eas_ctx context.Context
     eas_cancel context.CancelCauseFunc
     ffm_ctx context.Context
     ffm_cancel context.CancelFunc
-    queue []*youtube.Video
+    // Frames sent since the playthrough started, which together with the track's start gives the position
+    sent atomic.Int64
+    // How much faster than normal the filters play the track
+    tempo float64
+    // Kept up to date by the player, so the end of the track knows whether there is anything to crossfade into
+    next_queued atomic.Bool
 }
 
-var (
-    calls = map[string]Call{}
-    calls_mutx sync.Mutex
-)
+// What a playthrough sends back to the player when it ends
+type playback_result struct {
+    pb *playback
+    // Why the playthrough stopped, e.g. the track finished, was skipped or is being seeked
+    cause error
+    // Set if the track could not be played at all
+    err error
+    // Handed back so gapless playback can keep using it
+    opus_enc *gopus.Encoder
+    // The end of the track, held back to be mixed into the next one
+    tail [][]int16
+    // Set if the track's source had to be resolved, so playing it again does not fetch it again
+    source Source
+}
+
+// Given as the cause when the current track is stopped so it can be restarted at another position
+type seek_request struct {
+    position time.Duration
+}
 
 const (
     audio_chan int = 2
@@ -39,9 +90,37 @@ const (
     //audio_bitrate int = 64
     audio_bitrate int = 128
     audio_max_bytes int = (audio_frame_size * audio_chan) * 2
+    audio_frame_duration time.Duration = time.Duration(audio_frame_size) * time.Second / time.Duration(audio_sample_rate)
 )
 
 
+func (r *seek_request) Error() string {
+    return fmt.Sprintf("Seeking to %s", r.position)
+}
+
+
+func (d discord_voice) opus_send() chan<- []byte {
+    return d.vc.OpusSend
+}
+
+
+func (d discord_voice) speaking(speaking bool) error {
+    return d.vc.Speaking(speaking)
+}
+
+
+func (d discord_voice) move(channel_id string) error {
+    return d.vc.ChangeChannel(channel_id, false, true)
+}
+
+
+func (d discord_voice) disconnect() {
+    d.vc.Disconnect()
+    close(d.vc.OpusSend)
+    d.vc.Close()
+}
+
+
 func vc_from_message(s *discordgo.Session, m *discordgo.MessageCreate) (string, error)   {
     // Text Channel
     c, err := s.State.Channel(m.ChannelID)
@@ -66,44 +145,20 @@ func vc_from_message(s *discordgo.Session, m *discordgo.MessageCreate) (string,
 }
 
 
-func set_paused(s *discordgo.Session, m *discordgo.MessageCreate, val bool) {
-    calls_mutx.Lock()
-    call, exists := calls[m.GuildID]
-    if !exists {
-        s.ChannelMessageSend(m.ChannelID, "I'm not in a call, you can't tell me what to do with my life!")
-        calls_mutx.Unlock()
-        return
-    }
-
-    if !call.playing {
-        s.ChannelMessageSend(m.ChannelID, "Nothing is currently playing")
-        calls_mutx.Unlock()
-        return
-    }
-
-    *call.paused = val
-    switch val {
-    case false:
-        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Resumed %s", call.queue[0].Title))
-    case true:
-        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Paused %s, type `%cresume` to resume playing", call.queue[0].Title, settings.cmd_prefix))
-    }
-    calls[m.GuildID] = call
-    calls_mutx.Unlock()
-}
-
-
 func queue_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
     // Make sure the bot is in a call
-    _, exists := calls[m.GuildID]
-    if !exists {
+    p := get_player(m.GuildID)
+    if p == nil {
         s.ChannelMessageSend(m.ChannelID, "I'm not in a call, you don't live rent free in my head")
         return
     }
 
     var list string
-    for _, vid := range calls[m.GuildID].queue {
-        list+=fmt.Sprintf("\n(%s - [%v])", vid.Title, vid.Duration)
+    for _, track := range p.status() {
+        list+=fmt.Sprintf("\n(%s - [%s]) requested by %s", track.title, track.duration_string(), track.requester)
+    }
+    if effects := effects_summary(get_guild_settings(m.GuildID)); effects != "" {
+        list+=fmt.Sprintf("\nEffects: %s", effects)
     }
     s.ChannelMessageSend(m.ChannelID, "Queue (including currently playing): "+list)
 }
@@ -111,336 +166,475 @@ func queue_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
 
 func skip_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
     // Make sure the bot is in a call
-    _, exists := calls[m.GuildID]
-    if !exists {
+    p := get_player(m.GuildID)
+    if p == nil {
         s.ChannelMessageSend(m.ChannelID, "I'm not in a call, don't get ahead of yourself")
         return
     }
 
-    // Cancel all child threads that are being used to play the current song
-    calls[m.GuildID].ffm_cancel()
-    calls[m.GuildID].eas_cancel(fmt.Errorf("Skipped"))
-    calls[m.GuildID].bts_cancel()
-    // From here, the existing play_audio thread will do the rest
-
-    log.Printf("skip command executed\n")
+    // From here, the player does the rest
+    _, err := p.skip()
+    if err != nil {
+        s.ChannelMessageSend(m.ChannelID, err.Error())
+    }
 }
 
 
-func join_voice(s *discordgo.Session, guild_id string, vc_id string) error {
-    // Check if the bot is already in a call
-    calls_mutx.Lock()
-    _, exists := calls[guild_id]
-    if exists {
-        // If it is, leave the old call
-        log.Printf("already in a voice call\n")
-        calls_mutx.Unlock()
-        return fmt.Errorf("already in a voice call")
+func seek_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
+    argument := cmd_argument(m.Content)
+    if argument == "" {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid syntax: use `%cseek [time]`, e.g. `2:30`, `+30s` or `-10s`", settings.cmd_prefix))
+        return
     }
 
-    // Join the new voice channel
-    call, err := s.ChannelVoiceJoin(guild_id, vc_id, false, true) 
+    p := get_player(m.GuildID)
+    if p == nil {
+        s.ChannelMessageSend(m.ChannelID, err_nothing_playing.Error())
+        return
+    }
+
+    title, target, err := p.seek(argument)
     if err != nil {
-        calls_mutx.Unlock()
-        return fmt.Errorf("unable to join voice call: %s\n", err.Error())
+        s.ChannelMessageSend(m.ChannelID, err.Error())
+        return
     }
+    s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Seeking to %s in %s", target, title))
+}
 
-    // Create a new call object in the global calls map
-    paused := false
 
-    calls[guild_id] = Call{
-        vc: call,
-        playing: false,
-        should_exit: false,
-        paused: &paused,
-        queue: []*youtube.Video{},
+// Stops the playthrough with a seek as the cause, so the player starts the track again from the new position
+func (pb *playback) restart(position time.Duration) {
+    // Live streams have no position to go back to, they just start again from now
+    if pb.track.live {
+        position = 0
     }
-    calls_mutx.Unlock()
-
-    log.Printf("Joined a voice call in %s\n", guild_id)
-    return nil
+    pb.stop(&seek_request{position: position})
 }
 
 
-func leave_voice(guild_id string) {
-    // Make sure the call actually exists
-    calls_mutx.Lock()
-    call, exists := calls[guild_id]
-    if !exists {
-        calls_mutx.Unlock()
-        return
-    }
+// Cancels the sending threads, eas goes first so the cause is recorded before the others can end the track some other way
+func (pb *playback) stop(cause error) {
+    pb.eas_cancel(cause)
+    pb.ffm_cancel()
+    pb.bts_cancel()
+}
 
-    // Set the should exit flag high so the current go routine playing audio knows to stop
-    call.should_exit = true
-    calls[guild_id] = call
-    calls_mutx.Unlock()
 
-    // Cancel child threads of call
-    call.ffm_cancel()
-    call.bts_cancel()
-    call.eas_cancel(fmt.Errorf("Disconnected"))
+// How far into the track playback is, in the track's own time
+func (pb *playback) position() time.Duration {
+    played := float64(pb.sent.Load()) * float64(audio_frame_duration) * pb.tempo
+    return pb.track.start + time.Duration(played)
+}
 
-    var wait bool = true
-    for wait {
-        // Wait until play_audio is done
-        calls_mutx.Lock()
-        wait = calls[guild_id].playing
-        calls_mutx.Unlock()
-        time.Sleep(10 * time.Millisecond) 
+
+func parse_seek(argument string, position time.Duration) (time.Duration, error) {
+    sign := 0
+    switch argument[0] {
+    case '+':
+        sign = 1
+        argument = argument[1:]
+    case '-':
+        sign = -1
+        argument = argument[1:]
     }
 
-    // Disconnect, close channel, and close web socket
-    calls_mutx.Lock()
-    calls[guild_id].vc.Disconnect()
-    close(calls[guild_id].vc.OpusSend)
-    calls[guild_id].vc.Close()
-    
-    // Delete the entry from the hashmap
-    delete(calls, guild_id)
-    calls_mutx.Unlock()
+    offset, err := parse_timestamp(strings.TrimSuffix(argument, "s"))
+    if err != nil {
+        return 0, err
+    }
 
-    log.Printf("Left a voice call in %s\n", guild_id)
+    target := offset
+    if sign != 0 {
+        target = position + time.Duration(sign)*offset
+    }
+    if target < 0 {
+        target = 0
+    }
+    return target, nil
 }
 
 
 func play_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
-    cmd_sections := strings.Split(m.Content[1:], " ")
+    argument := cmd_argument(m.Content)
+
+    // With no link, play whatever audio files were uploaded with the message
+    if argument == "" && len(m.Attachments) > 0 {
+        play_attachments(s, m)
+        return
+    }
 
-    // Make sure the user has only put the play command and one argument
-    if len(cmd_sections) != 2 {
-        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid syntax: use `%cplay [link]`", settings.cmd_prefix))
+    // Make sure the user has given a link or something to search for
+    if argument == "" {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid syntax: use `%cplay [link or search]`, or attach an audio file", settings.cmd_prefix))
         return
     }
 
-    // Try to find the video specified in the command
-    vid, err := get_video(cmd_sections[1])
+    // Anything starting with lib: is looked up in the local music library instead of youtube
+    if strings.HasPrefix(argument, library_prefix) && strings.TrimSpace(argument[len(library_prefix):]) != "" {
+        play_library(s, m, strings.TrimSpace(argument[len(library_prefix):]))
+        return
+    }
+
+    // Links to anywhere other than youtube are played as plain audio streams, e.g. internet radio
+    if is_link(argument) && !is_youtube_link(argument) {
+        play_stream(s, m, argument)
+        return
+    }
+
+    // Playlist links queue every entry, unless the user asks for something else
+    fields := strings.Fields(argument)
+    if playlist_id(fields[0]) != "" && (len(fields) == 1 || fields[1] != playlist_mode_one) {
+        play_playlist(s, m, fields)
+        return
+    }
+
+    // Try to find the video specified in the command, searching youtube if it is not a link
+    if playlist_id(fields[0]) != "" {
+        argument = fields[0]
+    }
+    vid, err := get_video(argument)
     if err != nil {
-        s.ChannelMessageSend(m.ChannelID, "Could not find video, please try again (Node: Search is not currently implemented)")
+        s.ChannelMessageSend(m.ChannelID, youtube_error_message(err, "video"))
+        log.Printf("failed to get video: %s\n", err.Error())
         return 
     }
     log.Printf("found youtube video: [%s] - [%s]\n", vid.Title, vid.ID)
 
+    // Links with a start time (e.g. youtu.be/xyz?t=95) start playing from there
+    track := track_from_video(vid, m.Author.Username)
+    if start := link_start_time(argument); start > 0 && (track.duration == 0 || start < track.duration) {
+        track.start = start
+    }
+    enqueue_track(s, m, track)
+}
+
+
+func play_playlist(s *discordgo.Session, m *discordgo.MessageCreate, fields []string) {
+    link := fields[0]
+
+    // Links to a video within a playlist start from that video by default, plain playlist links queue everything
+    mode := playlist_mode_all
+    if playlist_video_id(link) != "" {
+        mode = playlist_mode_from
+    }
+    if len(fields) > 1 {
+        mode = fields[1]
+    }
+    if len(fields) > 2 || (mode != playlist_mode_all && mode != playlist_mode_from) {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid syntax: use `%cplay [playlist link] [all|from|one]`", settings.cmd_prefix))
+        return
+    }
 
+    vids, title, err := get_playlist(link, mode)
+    if err != nil {
+        s.ChannelMessageSend(m.ChannelID, youtube_error_message(err, "playlist"))
+        log.Printf("failed to get playlist: %s\n", err.Error())
+        return
+    }
+    log.Printf("found youtube playlist: [%s] - %d entries\n", title, len(vids))
+
+    enqueue_tracks(s, m, tracks_from_videos(vids, m.Author.Username), fmt.Sprintf("Queued %d tracks from %s", len(vids), title))
+}
+
+
+// Adds a track to the queue of the guild the message was sent in, joining the author's voice channel if needed
+func enqueue_track(s *discordgo.Session, m *discordgo.MessageCreate, track *Track) {
+    enqueue_tracks(s, m, []*Track{track}, fmt.Sprintf("Added '%s' to the queue", track.title))
+}
+
+
+// Adds several tracks to the queue at once, sending a single message to announce them
+// The player starts playing them if it is idle, this returns straight away either way
+func enqueue_tracks(s *discordgo.Session, m *discordgo.MessageCreate, tracks []*Track, announce string) {
     // Make sure the call exists, if it doesn't, try to join the voice channel
-    if _, exists := calls[m.GuildID]; !exists {
+    p := get_player(m.GuildID)
+    if p == nil {
         log.Printf("not currently in a voice call, attempting to join\n")
         vc_id, err := vc_from_message(s, m)
         if err != nil {
             s.ChannelMessageSend(m.ChannelID, "You are not currently within a voice call")
             log.Printf("could not find vc: %s\n", err.Error())
+            release_tracks(tracks)
             return
         }
-        err = join_voice(s, m.GuildID, vc_id)
+        p, err = join_voice(s, m.GuildID, vc_id, m.ChannelID)
         if err != nil {
             s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unable to join voice channel: %s", err.Error()))
             log.Printf("joining vc: %s", err.Error())
+            release_tracks(tracks)
             return
         }
     }
 
-    // Lock the calls mutx, for a fleeting feeling of thread safety
-    calls_mutx.Lock()
+    // Add the found tracks into the queue
+    if !p.enqueue(tracks, m.ChannelID) {
+        s.ChannelMessageSend(m.ChannelID, "I'm leaving the call, try again once I'm gone")
+        release_tracks(tracks)
+        return
+    }
+    s.ChannelMessageSend(m.ChannelID, announce)
+}
 
-    // Add the found video into the video queue
-    call := calls[m.GuildID]
-    call.queue = append(call.queue, vid) 
-    log.Printf("added song to queue: '%s'\n", vid.ID)
-    s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Added '%s' to the queue", vid.Title))
 
-    // If the voice connection is not currently playing, start playing
-    if !call.playing { 
-        call.playing = true
-        calls[m.GuildID] = call
-        calls_mutx.Unlock()
+// Plays the track through once, returning when it ends for whatever reason
+// Runs on its own goroutine, everything it needs from the player is copied into the playback when it starts
+// announce sends a message to the channel the queue was started from
+func (pb *playback) play(announce func(msg string)) playback_result {
+    result := playback_result{pb: pb, opus_enc: pb.opus_enc}
+    guild_id := pb.guild_id
+    track := pb.track
+    gs := pb.gs
+
+    // Any error from here on means the track can not be played at all, the player moves on to the next one
+    fail := func(err error) playback_result {
+        pb.stop(err)
+        log.Printf("error playing: %s\n", err.Error())
+        announce(fmt.Sprintf("Error while playing: %s", youtube_error_message(err, "video")))
+        result.cause = err
+        result.err = err
+        return result
+    }
 
-        // Turn this thread into the play_audio thread
-        log.Printf("no existing audio thread - creating new one\n")
-        err = play_audio(s, m.ChannelID, m.GuildID)
-        if err != nil {
-            log.Printf("error playing: %s\n", err.Error())
-            s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error while playing: %s", err.Error()))
+    // Control variables for multi threading
+    var wg sync.WaitGroup
+
+    // Obtain the audio from wherever the track comes from
+    // If the source already has opus packets, send them as is rather than decoding and re-encoding them
+    var audio_stream io.ReadCloser
+    var pcm_data_bytes io.ReadCloser
+    var short_chan chan []int16
+    var opus_reader OpusReader
+    var first_packet []byte
+    var err error
+
+    if pb.prefetch != nil {
+        log.Printf("using prefetched track\n")
+        <-pb.prefetch.done
+        result.source = pb.prefetch.source
+        if pb.prefetch.err != nil {
+            return fail(pb.prefetch.err)
         }
+        opus_reader, first_packet = pb.prefetch.opus_reader, pb.prefetch.first_packet
+        audio_stream, pcm_data_bytes = pb.prefetch.audio_stream, pb.prefetch.pcm
     } else {
-        calls[m.GuildID] = call
-        calls_mutx.Unlock()
-    }
-}
-
-
-func play_audio(s *discordgo.Session, txt_chan string, guild_id string) error {
-    // Set playing to false upon the return of this function
-    defer func() {
-        calls_mutx.Lock()
-        call, exists := calls[guild_id]
-        if !exists {
-            return
-        }   
-        call.playing = false
-        calls[guild_id] = call
-        calls_mutx.Unlock()
-    }()
-
-    // For each song in the queue
-    for {
-        calls_mutx.Lock()
-
-        var call Call
-        var exists bool
-
-        // Get the current call state, and make sure it still exists
-        call, exists = calls[guild_id]
-        if !exists {
-            calls_mutx.Unlock()
-            return fmt.Errorf("call missing")
+        // The track belongs to the run goroutine, so a resolved copy is used here and the source handed back with the result
+        track, err = resolve_track(track)
+        if err != nil {
+            return fail(err)
         }
-
-        // Only continue if there is at least one song in the queue
-        if len(calls[guild_id].queue) == 0 {
-            calls_mutx.Unlock()
-            return nil
+        if track.source != pb.track.source {
+            result.source = track.source
         }
 
-        // Check if this go-routine is instructed to exit
-        if call.should_exit {
-            calls_mutx.Unlock()
-            return nil
+        if can_passthrough(guild_id) {
+            opus_reader, first_packet = open_passthrough(track)
+        }
+        if opus_reader == nil {
+            audio_stream, err = track.source.open()
+            if err != nil {
+                return fail(err)
+            }
         }
+    }
 
-        // Create a new opus encoder that econdes pcm data into opus packets for discord
-        opus_enc, err := gopus.NewEncoder(audio_sample_rate, audio_chan, gopus.Audio)
+    // Create a new opus encoder that econdes pcm data into opus packets for discord, unless one was kept from the last track
+    opus_enc := pb.opus_enc
+    if opus_reader == nil && opus_enc == nil {
+        opus_enc, err = gopus.NewEncoder(audio_sample_rate, audio_chan, gopus.Audio)
         if err != nil {
-            calls_mutx.Unlock()
-            return fmt.Errorf("unable to make encoder: %s", err.Error())
+            audio_stream.Close()
+            if pcm_data_bytes != nil {
+                pcm_data_bytes.Close()
+            }
+            return fail(fmt.Errorf("unable to make encoder: %s", err.Error()))
         }
         opus_enc.SetBitrate(audio_bitrate * 1000)
+        result.opus_enc = opus_enc
+    }
 
-        // Tell discord we want to start speaking
-        call.vc.Speaking(true)
-
-        // Set contexts to new contexts with cancel
-        call.bts_ctx, call.bts_cancel = context.WithCancel(context.Background())
-        call.eas_ctx, call.eas_cancel = context.WithCancelCause(context.Background())
-        call.ffm_ctx, call.ffm_cancel = context.WithCancel(context.Background())
-        
-        // Update map with new call settings
-        calls[guild_id] = call
-        calls_mutx.Unlock()
-        
-        // Control variables for multi threading
-        var wg sync.WaitGroup 
-
-        // Obtain youtube audio only stream
-        audio_stream, err := get_audio_stream(calls[guild_id].queue[0])    
-        if err != nil {
-            return err
+    // Inform the users what will now be playing, unless this is the same track restarting after a seek
+    title := track.title
+    if !pb.seeking {
+        now_playing := fmt.Sprintf("Now Playing: %s [%s]", title, track.duration_string())
+        if track.start > 0 {
+            now_playing += fmt.Sprintf(" from %s", track.start)
         }
-        
-        // Inform the users what will now be playing
-        title := calls[guild_id].queue[0].Title
-        s.ChannelMessageSend(txt_chan, fmt.Sprintf("Now Playing: %s [%v]", title, calls[guild_id].queue[0].Duration)) 
+        if effects := effects_summary(gs); opus_reader == nil && effects != "" {
+            now_playing += fmt.Sprintf(" with %s", effects)
+        }
+        announce(now_playing)
+    }
 
-        // Use FFMpeg to convert the M4A AAC encoded file into raw PCM data
-        pcm_data_bytes, err := convert_m4a_pcm(audio_stream, calls[guild_id].ffm_ctx)
-        if err != nil {
-            return fmt.Errorf("converting m4a -> pcm: %s", err.Error())
+    // Save the packets as they are sent, so next time this track can come straight from the cache
+    // Only a track played from the very start, at its normal volume, can be complete
+    var cache_w *cache_writer
+    if track.start == 0 && can_passthrough(guild_id) {
+        cache_w = start_cache_write(track)
+    }
+
+    if opus_reader != nil {
+        log.Printf("using opus passthrough\n")
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            err := send_opus(opus_reader, first_packet, pb, cache_w)
+            if err != nil {
+                log.Printf("error while sending opus: %s\n", err.Error())
+            }
+            log.Printf("exited opus send loop\n")
+        }()
+    } else {
+        // Use FFMpeg to convert the encoded audio into raw PCM data, unless the prefetch already started it
+        if pcm_data_bytes == nil {
+            pcm_data_bytes, err = decode_pcm(audio_stream, track.start, pb.graph, pb.ffm_ctx)
+            if err != nil {
+                audio_stream.Close()
+                if cache_w != nil {
+                    cache_w.abort()
+                }
+                return fail(fmt.Errorf("converting audio -> pcm: %s", err.Error()))
+            }
         }
 
         // Get bytes from output of command, turn into int16 slices and send to encoding thread
-        short_chan := make(chan []int16, 30) 
+        short_chan = make(chan []int16, 30)
         wg.Add(1)
         go func() {
             defer wg.Done()
-            err := pcm_bts(pcm_data_bytes, short_chan, guild_id)
+            err := pcm_bts(pcm_data_bytes, short_chan, pb)
             if err != nil {
                 log.Printf("error while doing bts: %s\n", err.Error())
-            }   
+            }
             log.Printf("exited bts loop")
         }()
 
         // Encode PCM to Opus Thread
+        ramp := new_volume_ramp(gs.volume)
         wg.Add(1)
         go func() {
             defer wg.Done()
-            for calls[guild_id].playing {
+
+            // Encodes a frame and sends it to discord, returning false if the thread has been cancelled
+            send := func(pcm []int16) bool {
+                // Apply the guild's volume, which also makes the packets unsuitable for the cache
+                ramp.apply(pcm, get_guild_settings(guild_id).volume)
+                if cache_w != nil && !ramp.unity() {
+                    cache_w.invalidate("volume was changed")
+                }
+
+                // Encode into opus
+                opus, err := opus_enc.Encode(pcm, audio_frame_size, audio_max_bytes)
+                if err != nil {
+                    log.Printf("error while doing eas: %s\n", err.Error())
+                    return false
+                }
+
+                if !wait_if_paused(pb.pause, pb.vc, pb.eas_ctx) {
+                    log.Printf("eas cancelled while paused\n")
+                    return false
+                }
+
+                // Send to discord if the thread has not been cancelled
+                select {
+                case <- pb.eas_ctx.Done():
+                    log.Printf("eas cancelled check 2\n")
+                    return false
+                case pb.vc.opus_send() <- opus:
+                    pb.sent.Add(1)
+                    if cache_w != nil {
+                        cache_w.write_packet(opus)
+                    }
+                    return true
+                }
+            }
+
+            // With crossfade on, the last few seconds are held back so they can be mixed into the next track
+            hold := crossfade_frames(gs.crossfade)
+            var held [][]int16
+            fade_in := pb.fade_in
+            fade_step := 0
+
+            for {
                 // Get PCM data from FFMPEG in appropriately sized chunks to be converted to OPUS
                 select {
-                case <- calls[guild_id].eas_ctx.Done():
+                case <- pb.eas_ctx.Done():
                     log.Printf("eas cancelled check 1\n")
                     return
                 case pcm, ok := <- short_chan:
+                    // bts closes the channel once ffmpeg has nothing left
                     if !ok {
+                        // A track shorter than the crossfade still has to let the last one fade out
+                        for ; fade_step < len(fade_in); fade_step++ {
+                            silence := make([]int16, audio_frame_size*audio_chan)
+                            mix_crossfade(silence, fade_in[fade_step], fade_step, len(fade_in))
+                            held = append(held, silence)
+                        }
+
+                        // Hand the held back frames to the next track to fade into, or play them out if there is nothing next
+                        if hold > 0 && pb.next_queued.Load() {
+                            result.tail = held
+                        } else {
+                            for _, frame := range held {
+                                if !send(frame) {
+                                    return
+                                }
+                            }
+                        }
+                        pb.eas_cancel(err_song_finished)
                         return
                     }
 
-                    // Encode into opus
-                    opus, err := opus_enc.Encode(pcm, audio_frame_size, audio_max_bytes)
-                    if err != nil {
-                        log.Printf("error while doing eas: %s\n", err.Error())
-                        return
-                    }
-                    
-                    var paused *bool = calls[guild_id].paused
-                    for *paused {
-                        time.Sleep(20 * time.Millisecond)
+                    // Mix in the end of the previous track
+                    if fade_step < len(fade_in) {
+                        mix_crossfade(pcm, fade_in[fade_step], fade_step, len(fade_in))
+                        fade_step++
                     }
 
-                    // Send to discord if the thread has not been cancelled
-                    select {
-                    case <- calls[guild_id].eas_ctx.Done():
-                        log.Printf("eas cancelled check 2\n")
-                        return
-                    case call.vc.OpusSend <- opus:
+                    held = append(held, pcm)
+                    if len(held) <= hold {
                         continue
                     }
+                    frame := held[0]
+                    held = held[1:]
+                    if !send(frame) {
+                        return
+                    }
                 }
             }
-
-            log.Printf("exited eas loop\n")
         }()
+    }
 
-        // Wait for byte-to-short and encode-and-send threads to exit, either gracefully or failure
-        wg.Wait()
-        log.Printf("wait group complete\n")
+    // Wait for byte-to-short and encode-and-send threads to exit, either gracefully or failure
+    wg.Wait()
+    log.Printf("wait group complete\n")
 
-        // Close readers and channels for getting / encoding audio
-        // Leaves discord send chan open for next song
+    // Close readers for getting / encoding audio
+    // Leaves discord send chan open for next song
+    if opus_reader != nil {
+        opus_reader.Close()
+    } else {
         audio_stream.Close()
         pcm_data_bytes.Close()
-        close(short_chan)
-
-        calls_mutx.Lock()
-        
-        // Check if this call still exists
-        call, exists = calls[guild_id]
-        if !exists {
-            calls_mutx.Unlock()
-            return nil
-        }
-
-        // Tell discord we are done speaking
-        err = call.vc.Speaking(false)
-        if err != nil {
-            calls_mutx.Unlock()
-            return fmt.Errorf("problem stopping speaking: %s", err.Error())
-        }
+    }
 
-        // Remove from the queue
-        call = calls[guild_id]
-        if len(call.queue) > 0 {
-            call.queue = call.queue[1:]
+    // Only tracks that played all the way through are worth keeping
+    result.cause = context.Cause(pb.eas_ctx)
+    if cache_w != nil {
+        if errors.Is(result.cause, err_song_finished) {
+            cache_w.commit(track.duration)
         } else {
-            call.queue = []*youtube.Video{}
+            cache_w.abort()
         }
+    }
 
-        // Update calls map with new settings
-        calls[guild_id] = call
-        calls_mutx.Unlock()
-
-        // Inform users we are done playing the song and why
-        s.ChannelMessageSend(txt_chan, fmt.Sprintf("Stopped playing '%s' - %s", title, context.Cause(call.eas_ctx)))
-
-        log.Printf("stopped playing: %s", context.Cause(call.eas_ctx))
+    // Inform users we are done playing the song and why, a seek carries on with the same track
+    var seek *seek_request
+    if !errors.As(result.cause, &seek) {
+        announce(fmt.Sprintf("Stopped playing '%s' - %s", title, result.cause))
     }
-}
+    log.Printf("stopped playing: %s", result.cause)
 
+    // Make sure the other threads are cancelled too, whichever way the track ended
+    pb.stop(result.cause)
+    return result
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Scales PCM by a guild's volume, easing towards a new volume over a few frames so changes do not click
+type volume_ramp struct {
+    // Gain at the end of the last frame, 1 is unchanged
+    gain float64
+}
+
+const (
+    volume_max int = 200
+    // Largest change in gain from one frame to the next, so going from 100% to 0% takes 400ms
+    volume_ramp_step float64 = 0.05
+)
+
+
+func volume_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
+    argument := cmd_argument(m.Content)
+
+    // Without an argument, just show the current volume
+    if argument == "" {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Volume is %d%%", get_guild_settings(m.GuildID).volume))
+        return
+    }
+
+    volume, err := strconv.Atoi(strings.TrimSuffix(argument, "%"))
+    if err != nil || volume < 0 || volume > volume_max {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid syntax: use `%cvolume [0-%d]`", settings.cmd_prefix, volume_max))
+        return
+    }
+
+    // The playing track picks this up on its next frame
+    var old GuildSettings
+    update_guild_settings(m.GuildID, func(gs *GuildSettings) {
+        old = *gs
+        gs.volume = volume
+    })
+    if old.volume == volume {
+        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Volume is already %d%%", volume))
+        return
+    }
+
+    // A track sent as it is has to be restarted before its volume can change, which leaves a short gap
+    msg := fmt.Sprintf("Volume set to %d%%", volume)
+    if !changes_sound(old) && get_player(m.GuildID) != nil {
+        msg += ", the current track may stop for a moment while it switches over"
+    }
+    s.ChannelMessageSend(m.ChannelID, msg)
+}
+
+
+// Starts at the given volume, so a track that begins at a lowered volume does not ramp down from 100%
+func new_volume_ramp(volume int) *volume_ramp {
+    return &volume_ramp{gain: float64(volume) / 100}
+}
+
+
+// Scales a frame of interleaved PCM in place, clipping anything pushed past the limits of 16 bits
+func (v *volume_ramp) apply(pcm []int16, volume int) {
+    start := v.gain
+    end := float64(volume) / 100
+    end = math.Max(end, start-volume_ramp_step)
+    end = math.Min(end, start+volume_ramp_step)
+    v.gain = end
+
+    if start == 1 && end == 1 {
+        return
+    }
+
+    // The gain moves a little with every sample, rather than jumping at the start of the frame
+    frames := len(pcm) / audio_chan
+    for i := 0; i < frames; i++ {
+        gain := start + (end-start)*float64(i+1)/float64(frames)
+        for c := 0; c < audio_chan; c++ {
+            pcm[i*audio_chan+c] = clip_sample(float64(pcm[i*audio_chan+c]) * gain)
+        }
+    }
+}
+
+
+// Rounds a scaled sample back to 16 bits, clipping it if it went past the limits
+func clip_sample(sample float64) int16 {
+    return int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(sample))))
+}
+
+
+// Whether the audio is currently being left as it is
+func (v *volume_ramp) unity() bool {
+    return v.gain == 1
+}
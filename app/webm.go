@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Reads Opus packets straight out of a WebM / Matroska container, without decoding them
+// Only the elements needed to find the Opus track and its blocks are understood, everything else is skipped
+type webm_reader struct {
+    r *bufio.Reader
+    closer io.Closer
+    // Track number of the Opus track, 0 until the Tracks element has been read
+    opus_track uint64
+    // Frames from a laced block that have not been returned yet
+    pending [][]byte
+}
+
+// EBML element IDs, with their length marker bits left in as is the convention in the matroska spec
+const (
+    ebml_id_header uint32 = 0x1A45DFA3
+    ebml_id_segment uint32 = 0x18538067
+    ebml_id_tracks uint32 = 0x1654AE6B
+    ebml_id_track_entry uint32 = 0xAE
+    ebml_id_track_number uint32 = 0xD7
+    ebml_id_codec_id uint32 = 0x86
+    ebml_id_cluster uint32 = 0x1F43B675
+    ebml_id_block_group uint32 = 0xA0
+    ebml_id_block uint32 = 0xA1
+    ebml_id_simple_block uint32 = 0xA3
+
+    // Size value meaning the element continues until its parent ends, used by live streams
+    ebml_unknown_size uint64 = 1<<56 - 1
+
+    // Anything bigger than this is not a sane audio block, and probably means the stream is corrupt
+    webm_max_element_size uint64 = 16 * 1024 * 1024
+)
+
+
+func new_webm_reader(stream io.ReadCloser) *webm_reader {
+    return &webm_reader{
+        r: bufio.NewReaderSize(stream, 64*1024),
+        closer: stream,
+    }
+}
+
+
+func (w *webm_reader) Close() error {
+    return w.closer.Close()
+}
+
+
+// Returns the next Opus packet in the stream, or io.EOF once the stream is over
+func (w *webm_reader) read_packet() ([]byte, error) {
+    for len(w.pending) == 0 {
+        id, size, err := w.read_element_header()
+        if err != nil {
+            return nil, err
+        }
+
+        switch id {
+        // Master elements whose children are needed, step into them by carrying on with the next header
+        case ebml_id_segment, ebml_id_cluster, ebml_id_block_group, ebml_id_tracks:
+            continue
+
+        case ebml_id_track_entry:
+            err = w.read_track_entry(size)
+
+        case ebml_id_simple_block, ebml_id_block:
+            err = w.read_block(size)
+
+        default:
+            // Everything else (EBML header, cues, tags, timecodes, ...) is not needed
+            if size == ebml_unknown_size {
+                return nil, fmt.Errorf("webm: element 0x%X has unknown size", id)
+            }
+            _, err = w.r.Discard(int(size))
+            err = unexpected_eof(err)
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    packet := w.pending[0]
+    w.pending = w.pending[1:]
+    return packet, nil
+}
+
+
+// Reads a variable length integer, returning its value with the length marker removed and how many bytes it used
+func (w *webm_reader) read_vint() (uint64, int, error) {
+    first, err := w.r.ReadByte()
+    if err != nil {
+        return 0, 0, err
+    }
+
+    // The number of leading zero bits is the number of extra bytes
+    length := 1
+    for mask := byte(0x80); length <= 8 && first&mask == 0; mask >>= 1 {
+        length++
+    }
+    if length > 8 {
+        return 0, 0, fmt.Errorf("webm: invalid vint")
+    }
+
+    value := uint64(first) & (0xFF >> length)
+    all_ones := value == 0xFF>>length
+    for i := 1; i < length; i++ {
+        b, err := w.r.ReadByte()
+        if err != nil {
+            return 0, 0, unexpected_eof(err)
+        }
+        value = value<<8 | uint64(b)
+        all_ones = all_ones && b == 0xFF
+    }
+
+    // A size of all ones is reserved for "unknown", whatever the length of the vint
+    if all_ones {
+        return ebml_unknown_size, length, nil
+    }
+    return value, length, nil
+}
+
+
+func (w *webm_reader) read_element_header() (uint32, uint64, error) {
+    // IDs are vints too, but keep their marker bits
+    first, err := w.r.ReadByte()
+    if err != nil {
+        return 0, 0, err
+    }
+    id := uint32(first)
+    switch {
+    case first&0x80 != 0:
+    case first&0x40 != 0:
+        id, err = w.read_id_rest(id, 1)
+    case first&0x20 != 0:
+        id, err = w.read_id_rest(id, 2)
+    case first&0x10 != 0:
+        id, err = w.read_id_rest(id, 3)
+    default:
+        return 0, 0, fmt.Errorf("webm: invalid element id")
+    }
+    if err != nil {
+        return 0, 0, err
+    }
+
+    size, _, err := w.read_vint()
+    if err != nil {
+        return 0, 0, unexpected_eof(err)
+    }
+    return id, size, nil
+}
+
+
+func (w *webm_reader) read_id_rest(id uint32, extra int) (uint32, error) {
+    for i := 0; i < extra; i++ {
+        b, err := w.r.ReadByte()
+        if err != nil {
+            return 0, unexpected_eof(err)
+        }
+        id = id<<8 | uint32(b)
+    }
+    return id, nil
+}
+
+
+func (w *webm_reader) read_bytes(size uint64) ([]byte, error) {
+    if size > webm_max_element_size {
+        return nil, fmt.Errorf("webm: element of %d bytes is too big", size)
+    }
+    buf := make([]byte, size)
+    _, err := io.ReadFull(w.r, buf)
+    return buf, unexpected_eof(err)
+}
+
+
+// Reads a TrackEntry, remembering its track number if it is Opus
+func (w *webm_reader) read_track_entry(size uint64) error {
+    data, err := w.read_bytes(size)
+    if err != nil {
+        return err
+    }
+
+    // Parse the children of the entry from the buffered data
+    entry := &webm_reader{r: bufio.NewReader(bytes.NewReader(data))}
+    var number uint64
+    var codec string
+    for {
+        id, child_size, err := entry.read_element_header()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return err
+        }
+        value, err := entry.read_bytes(child_size)
+        if err != nil {
+            return err
+        }
+
+        switch id {
+        case ebml_id_track_number:
+            for _, b := range value {
+                number = number<<8 | uint64(b)
+            }
+        case ebml_id_codec_id:
+            codec = string(value)
+        }
+    }
+
+    if codec == "A_OPUS" && w.opus_track == 0 {
+        w.opus_track = number
+    }
+    return nil
+}
+
+
+// Reads a SimpleBlock or Block, splitting it into its frames if it is laced
+func (w *webm_reader) read_block(size uint64) error {
+    data, err := w.read_bytes(size)
+    if err != nil {
+        return err
+    }
+
+    block := &webm_reader{r: bufio.NewReader(bytes.NewReader(data))}
+    track, track_len, err := block.read_vint()
+    if err != nil {
+        return err
+    }
+    if w.opus_track == 0 {
+        return fmt.Errorf("webm: no opus track found before the first block")
+    }
+    if track != w.opus_track {
+        return nil
+    }
+
+    // Skip the 2 byte relative timecode, then read the flags
+    header_len := track_len + 3
+    if len(data) < header_len {
+        return fmt.Errorf("webm: block is too short")
+    }
+    flags := data[header_len-1]
+    payload := data[header_len:]
+
+    frames, err := unlace(payload, (flags>>1)&0x03)
+    if err != nil {
+        return err
+    }
+    w.pending = append(w.pending, frames...)
+    return nil
+}
+
+
+// Splits the payload of a block into frames based on its lacing type
+func unlace(payload []byte, lacing byte) ([][]byte, error) {
+    if lacing == 0 {
+        return [][]byte{payload}, nil
+    }
+
+    if len(payload) < 1 {
+        return nil, fmt.Errorf("webm: laced block is too short")
+    }
+    count := int(payload[0]) + 1
+    payload = payload[1:]
+    sizes := make([]int, count)
+
+    switch lacing {
+    // Xiph lacing, each size is a run of 255s plus a final byte
+    case 1:
+        pos := 0
+        for i := 0; i < count-1; i++ {
+            for {
+                if pos >= len(payload) {
+                    return nil, fmt.Errorf("webm: bad xiph lacing")
+                }
+                sizes[i] += int(payload[pos])
+                pos++
+                if payload[pos-1] != 0xFF {
+                    break
+                }
+            }
+        }
+        payload = payload[pos:]
+
+    // Fixed size lacing, every frame is the same size
+    case 2:
+        if len(payload)%count != 0 {
+            return nil, fmt.Errorf("webm: bad fixed lacing")
+        }
+        for i := range sizes {
+            sizes[i] = len(payload) / count
+        }
+        return split_frames(payload, sizes)
+
+    // EBML lacing, the first size is a vint and the rest are signed differences from the previous size
+    case 3:
+        laced := &webm_reader{r: bufio.NewReader(bytes.NewReader(payload))}
+        pos := 0
+        for i := 0; i < count-1; i++ {
+            value, length, err := laced.read_vint()
+            if err != nil {
+                return nil, fmt.Errorf("webm: bad ebml lacing")
+            }
+            pos += length
+            if i == 0 {
+                sizes[i] = int(value)
+                continue
+            }
+            // Signed vints are stored with a bias of half their range
+            bias := int64(1)<<(7*length-1) - 1
+            sizes[i] = sizes[i-1] + int(int64(value)-bias)
+        }
+        payload = payload[pos:]
+    }
+
+    // The last frame takes whatever is left
+    used := 0
+    for _, size := range sizes[:count-1] {
+        if size < 0 {
+            return nil, fmt.Errorf("webm: bad lacing")
+        }
+        used += size
+    }
+    sizes[count-1] = len(payload) - used
+    return split_frames(payload, sizes)
+}
+
+
+func split_frames(payload []byte, sizes []int) ([][]byte, error) {
+    frames := make([][]byte, 0, len(sizes))
+    for _, size := range sizes {
+        if size < 0 || size > len(payload) {
+            return nil, fmt.Errorf("webm: lace sizes do not match block size")
+        }
+        frames = append(frames, payload[:size])
+        payload = payload[size:]
+    }
+    return frames, nil
+}
+
+
+// A clean EOF in the middle of an element means the stream was cut short
+func unexpected_eof(err error) error {
+    if err == io.EOF {
+        return io.ErrUnexpectedEOF
+    }
+    return err
+}
+
+
+// Works out how much audio an Opus packet holds from its TOC byte (RFC 6716 section 3.1)
+func opus_packet_duration(packet []byte) (time.Duration, error) {
+    if len(packet) < 1 {
+        return 0, fmt.Errorf("empty opus packet")
+    }
+
+    config := packet[0] >> 3
+    var frame time.Duration
+    switch {
+    // SILK only
+    case config < 12:
+        frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+    // Hybrid
+    case config < 16:
+        frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+    // CELT only
+    default:
+        frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+    }
+
+    var frames int
+    switch packet[0] & 0x03 {
+    case 0:
+        frames = 1
+    case 1, 2:
+        frames = 2
+    case 3:
+        if len(packet) < 2 {
+            return 0, fmt.Errorf("opus packet is too short")
+        }
+        frames = int(packet[1] & 0x3F)
+    }
+
+    return frame * time.Duration(frames), nil
+}
+
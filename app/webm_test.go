@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// Size bytes meaning "unknown", as live streams write for their segment and clusters
+var webm_unknown_size_bytes = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+
+func webm_reader_for(data []byte) *webm_reader {
+    return new_webm_reader(io.NopCloser(bytes.NewReader(data)))
+}
+
+
+// Encodes a value as a vint of the given length in bytes
+func test_vint(value uint64, length int) []byte {
+    b := make([]byte, length)
+    for i := length - 1; i >= 0; i-- {
+        b[i] = byte(value)
+        value >>= 8
+    }
+    b[0] |= 0x80 >> (length - 1)
+    return b
+}
+
+
+// Encodes an element, its ID written as in the spec and its size as a 4 byte vint
+func test_element(id uint32, data ...[]byte) []byte {
+    var out []byte
+    for shift := 24; shift >= 0; shift -= 8 {
+        if b := byte(id >> shift); b != 0 || len(out) > 0 {
+            out = append(out, b)
+        }
+    }
+    body := bytes.Join(data, nil)
+    out = append(out, test_vint(uint64(len(body)), 4)...)
+    return append(out, body...)
+}
+
+
+// Encodes the start of an element whose size is unknown, its children simply follow it
+func test_unknown_element(id uint32) []byte {
+    out := test_element(id)
+    return append(out[:len(out)-4], webm_unknown_size_bytes...)
+}
+
+
+func test_simple_block(track uint64, lacing byte, payload []byte) []byte {
+    header := append(test_vint(track, 1), 0x00, 0x00, 0x80|lacing<<1)
+    return test_element(ebml_id_simple_block, header, payload)
+}
+
+
+func test_track_entry(number byte, codec string) []byte {
+    return test_element(ebml_id_track_entry, test_element(ebml_id_track_number, []byte{number}), test_element(ebml_id_codec_id, []byte(codec)))
+}
+
+
+func TestWebmVint(t *testing.T) {
+    valid := []struct {
+        data []byte
+        value uint64
+        length int
+    }{
+        {[]byte{0x81}, 1, 1},
+        {[]byte{0x40, 0x02}, 2, 2},
+        {[]byte{0x41, 0x2C}, 300, 2},
+        {[]byte{0x20, 0x01, 0x00}, 256, 3},
+        {[]byte{0x10, 0x00, 0x00, 0x04}, 4, 4},
+        {[]byte{0x08, 0x00, 0x00, 0x00, 0x05}, 5, 5},
+        {[]byte{0x04, 0x00, 0x00, 0x00, 0x00, 0x06}, 6, 6},
+        {[]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07}, 7, 7},
+        {[]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00}, 256, 8},
+        // All ones is unknown at any width
+        {[]byte{0xFF}, ebml_unknown_size, 1},
+        {[]byte{0x7F, 0xFF}, ebml_unknown_size, 2},
+        {webm_unknown_size_bytes, ebml_unknown_size, 8},
+        // Only the value bits count, a longer vint with the top bits set is a normal value
+        {[]byte{0x7F, 0xFE}, 0x3FFE, 2},
+    }
+    for _, v := range valid {
+        value, length, err := webm_reader_for(v.data).read_vint()
+        if err != nil || value != v.value || length != v.length {
+            t.Errorf("% X gave %d, %d, %v, expected %d, %d", v.data, value, length, err, v.value, v.length)
+        }
+    }
+
+    if _, _, err := webm_reader_for([]byte{0x00, 0x01}).read_vint(); err == nil {
+        t.Errorf("a vint longer than 8 bytes was accepted")
+    }
+    if _, _, err := webm_reader_for([]byte{0x10, 0x00}).read_vint(); err != io.ErrUnexpectedEOF {
+        t.Errorf("a cut off vint gave %v", err)
+    }
+}
+
+
+func TestWebmUnlace(t *testing.T) {
+    first := bytes.Repeat([]byte{1}, 300)
+    second := bytes.Repeat([]byte{2}, 290)
+    third := bytes.Repeat([]byte{3}, 490)
+    last := []byte{4, 4, 4, 4}
+    data := bytes.Join([][]byte{first, second, third, last}, nil)
+
+    // Xiph sizes are runs of 255 plus a final byte
+    xiph := append([]byte{3, 0xFF, 45, 0xFF, 35, 0xFF, 235}, data...)
+    // EBML sizes are a vint and then signed differences, -10 in one byte and +200 in two
+    ebml := append([]byte{3, 0x41, 0x2C, 0x80 | (63 - 10)}, test_vint(8191+200, 2)...)
+    ebml = append(ebml, data...)
+
+    for name, laced := range map[string]struct {
+        payload []byte
+        lacing byte
+    }{"xiph": {xiph, 1}, "ebml": {ebml, 3}} {
+        frames, err := unlace(laced.payload, laced.lacing)
+        if err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        if len(frames) != 4 || !bytes.Equal(frames[0], first) || !bytes.Equal(frames[1], second) || !bytes.Equal(frames[2], third) || !bytes.Equal(frames[3], last) {
+            t.Fatalf("%s: frames were split wrongly", name)
+        }
+    }
+
+    frames, err := unlace([]byte{2, 'a', 'b', 'c', 'd', 'e', 'f'}, 2)
+    if err != nil || len(frames) != 3 || string(frames[2]) != "ef" {
+        t.Fatalf("fixed lacing gave %q, %v", frames, err)
+    }
+
+    // Sizes that do not fit the block are errors, never a panic
+    bad := []struct {
+        payload []byte
+        lacing byte
+    }{
+        {[]byte{}, 1},
+        {[]byte{1, 0xFF, 0xFF}, 1},
+        {[]byte{1, 10, 'a'}, 1},
+        {[]byte{2, 'a', 'b'}, 2},
+        {[]byte{1, 0x40}, 3},
+        {[]byte{1, 0x8A, 'a'}, 3},
+        {[]byte{2, 0x81, 0x80, 'a', 'b'}, 3},
+        {append([]byte{1}, webm_unknown_size_bytes...), 3},
+    }
+    for _, b := range bad {
+        if frames, err := unlace(b.payload, b.lacing); err == nil {
+            t.Errorf("% X with lacing %d gave %q", b.payload, b.lacing, frames)
+        }
+    }
+}
+
+
+// A live style stream, with an unknown size segment and clusters, a video track to ignore and laced blocks
+func test_webm_stream() ([]byte, [][]byte) {
+    laced := []byte{1, 0x03, 'x', 'y', 'z', 'w'}
+    stream := bytes.Join([][]byte{
+        test_element(ebml_id_header, test_element(0x4286, []byte{1})),
+        test_unknown_element(ebml_id_segment),
+        test_element(ebml_id_tracks, test_track_entry(1, "V_VP9"), test_track_entry(2, "A_OPUS")),
+        test_unknown_element(ebml_id_cluster),
+        test_element(0xE7, []byte{0}),
+        test_simple_block(2, 0, []byte("one")),
+        test_simple_block(1, 0, []byte("video")),
+        test_element(ebml_id_block_group, test_element(ebml_id_block, []byte{0x82, 0, 0, 0}, []byte("two"))),
+        test_unknown_element(ebml_id_cluster),
+        test_element(0xE7, []byte{1}),
+        test_simple_block(2, 1, laced),
+        test_element(0x1C53BB6B, bytes.Repeat([]byte{0}, 20)),
+    }, nil)
+    return stream, [][]byte{[]byte("one"), []byte("two"), []byte("xyz"), []byte("w")}
+}
+
+
+func read_all_packets(w *webm_reader) ([][]byte, error) {
+    var packets [][]byte
+    for {
+        packet, err := w.read_packet()
+        if err != nil {
+            return packets, err
+        }
+        packets = append(packets, packet)
+    }
+}
+
+
+func TestWebmUnknownSizes(t *testing.T) {
+    stream, expected := test_webm_stream()
+    packets, err := read_all_packets(webm_reader_for(stream))
+    if err != io.EOF {
+        t.Fatalf("stream ended with %v", err)
+    }
+    if len(packets) != len(expected) {
+        t.Fatalf("got %q, expected %q", packets, expected)
+    }
+    for i := range expected {
+        if !bytes.Equal(packets[i], expected[i]) {
+            t.Fatalf("got %q, expected %q", packets, expected)
+        }
+    }
+
+    // Unknown sizes only make sense for elements that are stepped into
+    bad := append(test_element(ebml_id_header), test_unknown_element(0xE7)...)
+    if _, err := read_all_packets(webm_reader_for(bad)); err == io.EOF || err == nil {
+        t.Fatalf("an unknown size element that has to be skipped gave %v", err)
+    }
+}
+
+
+func TestWebmTruncated(t *testing.T) {
+    stream, expected := test_webm_stream()
+
+    // Cutting the stream anywhere gives the packets before the cut, then an error
+    for cut := 0; cut < len(stream); cut++ {
+        packets, err := read_all_packets(webm_reader_for(stream[:cut]))
+        if err == nil {
+            t.Fatalf("cut at %d: no error", cut)
+        }
+        if len(packets) > len(expected) {
+            t.Fatalf("cut at %d: too many packets", cut)
+        }
+        for i := range packets {
+            if !bytes.Equal(packets[i], expected[i]) {
+                t.Fatalf("cut at %d: got %q", cut, packets)
+            }
+        }
+    }
+
+    // A cut partway through an element is not mistaken for the end of the stream, whether the element is read or skipped
+    for _, cut := range []int{len(stream) - 5, len(stream) - 30} {
+        _, err := read_all_packets(webm_reader_for(stream[:cut]))
+        if !errors.Is(err, io.ErrUnexpectedEOF) {
+            t.Errorf("cut at %d gave %v, expected an unexpected EOF", cut, err)
+        }
+    }
+
+    // Blocks before the opus track is known can not be read
+    no_tracks := append(test_unknown_element(ebml_id_cluster), test_simple_block(1, 0, []byte("a"))...)
+    if _, err := read_all_packets(webm_reader_for(no_tracks)); err == io.EOF {
+        t.Fatalf("a block with no tracks ended cleanly")
+    }
+}
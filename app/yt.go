@@ -1,91 +1,228 @@
 package main
 
 import (
-	"fmt"
 	"io"
 	"log"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/kkdai/youtube/v2"
 )
 
 
-func download_cmd(s *discordgo.Session, m *discordgo.MessageCreate) {
-    cmd_sections := strings.Split(m.Content[1:], " ")
-
-    // Make sure command is formatted correctly
-    if len(cmd_sections) != 2 {
-        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("invalid syntax: use `%cdl [link]`", settings.cmd_prefix))
-        return
-    }
-
-    // Get the file and upload it to discord
-    get_file(s, m.ChannelID, cmd_sections[1]) 
-    
+func is_link(argument string) bool {
+    return strings.HasPrefix(argument, "http://") || strings.HasPrefix(argument, "https://")
 }
 
 
-func get_file(s *discordgo.Session, channel_id string, argument string) {
-    // Get the video based on the argument
-    video, err := get_video(argument) 
+// Checks if a link points at youtube, rather than some other website
+func is_youtube_link(link string) bool {
+    u, err := url.Parse(link)
     if err != nil {
-        log.Printf("failed to get video: %s\n", err.Error())
-        return 
+        return false
     }
+    host := strings.ToLower(u.Hostname())
+    return host == "youtu.be" || host == "youtube.com" || strings.HasSuffix(host, ".youtube.com")
+}
+
 
-    // Get the stream based on the argument
-    stream, err := get_audio_stream(video)
+// Reads the start time from a youtube link, e.g. ?t=95, ?t=95s or ?t=1m35s, returning 0 if there is none
+func link_start_time(link string) time.Duration {
+    if !is_youtube_link(link) {
+        return 0
+    }
+    u, err := url.Parse(link)
     if err != nil {
-        log.Printf("failed to get audio stream: %s\n", err.Error())
-        return
+        return 0
+    }
+    t := u.Query().Get("t")
+    if t == "" {
+        t = u.Query().Get("start")
+    }
+    if t == "" {
+        return 0
     }
 
-    // Send the raw m4a data to discord as a file upload
-    s.ChannelMessageSend(channel_id, fmt.Sprintf("Here is the audio for %s", video.Title))
-    s.ChannelFileSend(channel_id, "song.m4a", stream)
+    // Plain numbers are seconds
+    if _, err := strconv.Atoi(t); err == nil {
+        t += "s"
+    }
+    start, err := time.ParseDuration(t)
+    if err != nil || start < 0 {
+        return 0
+    }
+    return start
 }
 
 
 func get_video(argument string) (*youtube.Video, error) {
-    client := youtube.Client{}
+    id, err := video_id(argument)
+    if err != nil {
+        return nil, err
+    }
+    return get_video_by_id(id)
+}
 
-    var id string
-    var err error
 
+// Works out which video the user means, from a link or by searching and taking the top result
+func video_id(argument string) (string, error) {
     // If the provided argument is a URL, just use that
-    if strings.HasPrefix(argument, "http://") || strings.HasPrefix(argument, "https://") {
-        id, err = youtube.ExtractVideoID(argument)
+    if is_link(argument) {
+        id, err := youtube.ExtractVideoID(argument)
         if err != nil {
-            return nil, err
+            return "", classify_youtube_error(err)
         }
-    } else {
-        // otherwise, assume the user wants to search
+        return id, nil
+    }
 
-        // TODO : Implement youtube search
-        return nil, fmt.Errorf("search not currently implemented")
+    // otherwise, assume the user wants to search and take the top result
+    results, err := searcher.search(argument, 1)
+    if err != nil {
+        return "", &YoutubeError{kind: yt_err_network, err: err}
+    }
+    if len(results) < 1 {
+        return "", new_youtube_error(yt_err_not_found, "no search results for '%s'", argument)
     }
-    
+    return results[0].id, nil
+}
+
+
+func get_video_by_id(id string) (*youtube.Video, error) {
+    client := youtube.Client{}
+
     // Obtain a video object based on the video ID
     video, err := client.GetVideo(id)
     if err != nil {
-        return nil, err
+        return nil, classify_youtube_error(err)
     }
 
     return video, nil
-    
 }
 
 
-func get_audio_stream(video *youtube.Video) (io.ReadCloser, error) {
-    client := youtube.Client{}
+func get_audio_stream(video *youtube.Video) (io.ReadCloser, *youtube.Format, error) {
+    video, err := resolve_formats(video)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    format, err := select_audio_format(video)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    stream, err := open_format(video, format)
+    if err != nil {
+        return nil, nil, classify_youtube_error(err)
+    }
+    return stream, format, nil
+}
+
 
+// Videos queued from a playlist only have their metadata, so fetch the formats if they are missing
+// The given video is returned as is if it already has them, it is never changed as other goroutines may be reading it
+func resolve_formats(video *youtube.Video) (*youtube.Video, error) {
+    if len(video.Formats) > 0 {
+        return video, nil
+    }
+    return get_video_by_id(video.ID)
+}
+
+
+// Opens a stream for a format, which resumes by itself if the connection drops partway through
+func open_format(video *youtube.Video, format *youtube.Format) (io.ReadCloser, error) {
+    return new_resilient_stream(video, format)
+}
+
+
+// Returns the codec of a format from its mime type, e.g. `audio/webm; codecs="opus"` -> "opus"
+func format_codec(format *youtube.Format) string {
+    _, params, found := strings.Cut(format.MimeType, "codecs=")
+    if !found {
+        return ""
+    }
+    codec := strings.Trim(params, `" `)
+    // AAC is reported with its profile, e.g. mp4a.40.2
+    codec, _, _ = strings.Cut(codec, ".")
+    if codec == "mp4a" {
+        return "aac"
+    }
+    return codec
+}
+
+
+// Returns the file extension matching the container of a format, e.g. "webm" or "m4a"
+func format_extension(format *youtube.Format) string {
+    switch {
+    case strings.Contains(format.MimeType, "webm"):
+        return "webm"
+    case strings.HasPrefix(format.MimeType, "audio/mp4"):
+        return "m4a"
+    default:
+        return "mp4"
+    }
+}
+
+
+func format_bitrate(format *youtube.Format) int {
+    if format.AverageBitrate > 0 {
+        return format.AverageBitrate
+    }
+    return format.Bitrate
+}
+
+
+// Ranks how well a format fits the configured codec preferences, lower is better
+func codec_rank(format *youtube.Format) int {
+    codec := format_codec(format)
+    for i, preferred := range settings.audio_codecs {
+        if codec == preferred {
+            return i
+        }
+    }
+    return len(settings.audio_codecs)
+}
+
+
+// Picks the best format to stream audio from
+// Audio only formats come first so no bandwidth is wasted on video, then formats under the bitrate cap,
+// then the configured codec preference, then the highest bitrate
+func select_audio_format(video *youtube.Video) (*youtube.Format, error) {
     formats := video.Formats.WithAudioChannels()
     if len(formats) < 1 {
-        return nil, fmt.Errorf("no formats returned")
+        return nil, new_youtube_error(yt_err_no_audio, "no formats with audio for [%s]", video.ID)
     }
 
-    stream, _, err := client.GetStream(video, &formats[0])
-    return stream, err
+    ranked := make(youtube.FormatList, len(formats))
+    copy(ranked, formats)
 
-}   
+    under_cap := func(f *youtube.Format) bool {
+        return settings.audio_max_bitrate == 0 || format_bitrate(f) <= settings.audio_max_bitrate
+    }
+
+    sort.SliceStable(ranked, func(i, j int) bool {
+        a, b := &ranked[i], &ranked[j]
+
+        a_audio, b_audio := strings.HasPrefix(a.MimeType, "audio/"), strings.HasPrefix(b.MimeType, "audio/")
+        if a_audio != b_audio {
+            return a_audio
+        }
+        if under_cap(a) != under_cap(b) {
+            return under_cap(a)
+        }
+        if codec_rank(a) != codec_rank(b) {
+            return codec_rank(a) < codec_rank(b)
+        }
+        return format_bitrate(a) > format_bitrate(b)
+    })
+
+    best := &ranked[0]
+    log.Printf("selected itag %d for [%s]: %s, audio only: %t, %d kbps, under cap: %t (%d candidates)\n",
+        best.ItagNo, video.ID, best.MimeType, strings.HasPrefix(best.MimeType, "audio/"),
+        format_bitrate(best)/1000, under_cap(best), len(ranked))
+
+    return best, nil
+}
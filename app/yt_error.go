@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// The ways fetching something from youtube can fail, each of which gets its own message in the channel
+type YoutubeErrorKind int
+
+const (
+    yt_err_unknown YoutubeErrorKind = iota
+    yt_err_not_found
+    yt_err_private
+    yt_err_age_restricted
+    yt_err_region_blocked
+    yt_err_no_audio
+    yt_err_network
+)
+
+// An error from the youtube layer, sorted into one of the kinds above
+// The original error is kept for the logs
+type YoutubeError struct {
+    kind YoutubeErrorKind
+    // Youtube's own explanation, when it gave one
+    reason string
+    err error
+}
+
+
+func (e *YoutubeError) Error() string {
+    return e.err.Error()
+}
+
+
+func (e *YoutubeError) Unwrap() error {
+    return e.err
+}
+
+
+func new_youtube_error(kind YoutubeErrorKind, format string, a ...any) error {
+    return &YoutubeError{kind: kind, err: fmt.Errorf(format, a...)}
+}
+
+
+// Sorts an error from the youtube library or the network into a YoutubeError, leaving ones that already are alone
+func classify_youtube_error(err error) error {
+    if err == nil {
+        return nil
+    }
+    var yt_err *YoutubeError
+    if errors.As(err, &yt_err) {
+        return err
+    }
+
+    e := &YoutubeError{kind: yt_err_unknown, err: err}
+
+    var status *youtube.ErrPlayabiltyStatus
+    var playlist_status youtube.ErrPlaylistStatus
+    var code youtube.ErrUnexpectedStatusCode
+    var net_err net.Error
+
+    switch {
+    case errors.Is(err, youtube.ErrVideoPrivate):
+        e.kind = yt_err_private
+    // The library wraps whatever went wrong while trying to get around an age restriction
+    case errors.Is(err, youtube.ErrLoginRequired), strings.Contains(err.Error(), "age restriction"):
+        e.kind = yt_err_age_restricted
+    case errors.Is(err, youtube.ErrInvalidCharactersInVideoID), errors.Is(err, youtube.ErrVideoIDMinLength), errors.Is(err, youtube.ErrInvalidPlaylist):
+        e.kind = yt_err_not_found
+    case errors.As(err, &status):
+        e.kind = playability_kind(status.Status, status.Reason)
+        e.reason = status.Reason
+    case errors.As(err, &playlist_status):
+        e.kind = playability_kind("", playlist_status.Reason)
+        e.reason = playlist_status.Reason
+    case errors.As(err, &code):
+        if code == http.StatusNotFound || code == http.StatusGone {
+            e.kind = yt_err_not_found
+        } else {
+            e.kind = yt_err_network
+        }
+    case errors.As(err, &net_err), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, context.DeadlineExceeded):
+        e.kind = yt_err_network
+    }
+    return e
+}
+
+
+// Works out the kind of error from a playability status, which youtube only explains in its reason text
+func playability_kind(status string, reason string) YoutubeErrorKind {
+    reason = strings.ToLower(reason)
+    switch {
+    case status == "AGE_CHECK_REQUIRED" || status == "AGE_VERIFICATION_REQUIRED" || status == "CONTENT_CHECK_REQUIRED" ||
+        strings.Contains(reason, "confirm your age") || strings.Contains(reason, "age-restricted"):
+        return yt_err_age_restricted
+    case strings.Contains(reason, "country"):
+        return yt_err_region_blocked
+    case strings.Contains(reason, "private"):
+        return yt_err_private
+    case status == "ERROR" || strings.Contains(reason, "unavailable") || strings.Contains(reason, "does not exist") ||
+        strings.Contains(reason, "removed") || strings.Contains(reason, "terminated"):
+        return yt_err_not_found
+    }
+    return yt_err_unknown
+}
+
+
+// Explains what went wrong in words that make sense in the channel
+// what is the thing that was being fetched, e.g. "video" or "playlist"
+// Errors from outside the youtube layer are already readable enough, so they are returned as they are
+func youtube_error_message(err error, what string) string {
+    var yt_err *YoutubeError
+    if !errors.As(err, &yt_err) {
+        return err.Error()
+    }
+
+    switch yt_err.kind {
+    case yt_err_not_found:
+        return fmt.Sprintf("Could not find that %s on youtube, check the link or try a different search", what)
+    case yt_err_private:
+        return fmt.Sprintf("That %s is private", what)
+    case yt_err_age_restricted:
+        return fmt.Sprintf("That %s is age restricted, and can not be played without signing in to youtube", what)
+    case yt_err_region_blocked:
+        return fmt.Sprintf("That %s is not available in the country the bot is running in", what)
+    case yt_err_no_audio:
+        return fmt.Sprintf("That %s has no audio that can be played", what)
+    case yt_err_network:
+        return "Unable to reach youtube right now, please try again in a moment"
+    }
+
+    if yt_err.reason != "" {
+        return fmt.Sprintf("Youtube will not play that %s: %s", what, yt_err.reason)
+    }
+    return fmt.Sprintf("Something went wrong getting that %s from youtube", what)
+}